@@ -0,0 +1,342 @@
+package hamming
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"unsafe"
+)
+
+// SampleDistanceDistribution picks random pairs of hashes in the DB and
+// returns a histogram of the distances between the hashes in the pairs
+// histogram[d] is the number of pairs with the hamming distance 'd'
+// Most pairs at short distances means a clustered data set, a peak around
+// HashSize/2 means a uniform data set
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) SampleDistanceDistribution(samples int, seed int64) []int {
+	histogram := make([]int, h.config.HashSize+1)
+	hashes := h.hashes
+	if len(h.hashesLookup) != len(hashes) { // skip the removed hashes
+		hashes = make([]FuzzyHash, 0, len(h.hashesLookup))
+		h.forEachHash(func(hash FuzzyHash) {
+			hashes = append(hashes, hash)
+		})
+	}
+	if len(hashes) < 2 {
+		return histogram
+	}
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; i < samples; i++ {
+		first := random.Intn(len(hashes))
+		second := random.Intn(len(hashes) - 1)
+		if second >= first { // a pair of different hashes
+			second++
+		}
+		hammingDistance := h.hammingDistance(hashes[first], hashes[second])
+		histogram[hammingDistance]++
+	}
+	return histogram
+}
+
+// CandidateEfficiency returns the fraction of the candidates collected by
+// the multi-index for the specified hash which are within MaxDistance
+// Low efficiency means that the index wastes most distance calculations
+// I return 0 if there are no candidates
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) CandidateEfficiency(query FuzzyHash) float64 {
+	query = query.maskPadding(h.config.HashSize)
+	candidates, withinDistance := 0, 0
+	h.visitCandidates(query, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		candidates++
+		if h.hammingDistance(query, candidateHash) <= h.config.MaxDistance {
+			withinDistance++
+		}
+		return true
+	})
+	if candidates == 0 {
+		return 0
+	}
+	return float64(withinDistance) / float64(candidates)
+}
+
+// MostCommon returns up to n hashes added to the DB most times. All
+// siblings have distance 0. Hashes added the same number of times come in
+// the order of insertion
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) MostCommon(n int) []Sibling {
+	if n <= 0 {
+		return nil
+	}
+	var hashes []FuzzyHash
+	var occurrences []int
+	h.forEachHash(func(hash FuzzyHash) {
+		hashes = append(hashes, hash)
+		occurrences = append(occurrences, 1+int(h.duplicates[hash.toKey()]))
+	})
+	order := make([]int, len(hashes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return occurrences[order[i]] > occurrences[order[j]]
+	})
+	if n > len(order) {
+		n = len(order)
+	}
+	siblings := make([]Sibling, n)
+	for i := range siblings {
+		siblings[i] = Sibling{s: hashes[order[i]], distance: 0}
+	}
+	return siblings
+}
+
+// Diameter returns the maximum hamming distance between two hashes in
+// the set. I compare all pairs of hashes, this is O(N^2)
+// The hashes shall be of the same size
+func Diameter(hashes []FuzzyHash) (int, error) {
+	if err := sameSize(hashes); err != nil {
+		return 0, err
+	}
+	diameter := 0
+	for i, hash := range hashes {
+		for _, other := range hashes[i+1:] {
+			if hammingDistance := distanceUint64s(hash, other); hammingDistance > diameter {
+				diameter = hammingDistance
+			}
+		}
+	}
+	return diameter, nil
+}
+
+// DiameterSampled returns the maximum hamming distance between two hashes
+// in random pairs picked from the set. The result never exceeds the
+// result of Diameter()
+func DiameterSampled(hashes []FuzzyHash, samples int, seed int64) (int, error) {
+	if err := sameSize(hashes); err != nil {
+		return 0, err
+	}
+	diameter := 0
+	if len(hashes) < 2 {
+		return diameter, nil
+	}
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; i < samples; i++ {
+		first := random.Intn(len(hashes))
+		second := random.Intn(len(hashes) - 1)
+		if second >= first { // a pair of different hashes
+			second++
+		}
+		if hammingDistance := distanceUint64s(hashes[first], hashes[second]); hammingDistance > diameter {
+			diameter = hammingDistance
+		}
+	}
+	return diameter, nil
+}
+
+// CompareIndices runs the queries in both DBs and returns the differences
+// between the distances a - b, one per query. The DBs can use different
+// block layouts. I compare only up to the smaller MaxDistance: a distance
+// beyond the threshold counts as the threshold + 1
+// Zero everywhere means that the DBs agree
+func CompareIndices(a, b *H, queries []FuzzyHash) []int {
+	threshold := a.config.MaxDistance
+	if b.config.MaxDistance < threshold {
+		threshold = b.config.MaxDistance
+	}
+	clip := func(sibling Sibling) int {
+		if (sibling.s == nil) || (sibling.distance > threshold) {
+			return threshold + 1
+		}
+		return sibling.distance
+	}
+	differences := make([]int, len(queries))
+	for i, query := range queries {
+		differences[i] = clip(a.ShortestDistance(query)) - clip(b.ShortestDistance(query))
+	}
+	return differences
+}
+
+func sameSize(hashes []FuzzyHash) error {
+	for i, hash := range hashes {
+		if len(hash) != len(hashes[0]) {
+			return fmt.Errorf("hash %d is %d bits, expected %d bits", i, hash.Bits(), hashes[0].Bits())
+		}
+	}
+	return nil
+}
+
+// PairsWithin returns all pairs of hashes within the specified distance
+// A pair is the indexes of the hashes in the order of insertion, the first
+// index is smaller. The pairs are sorted
+// If the multi-index guarantees to find all siblings within the distance I
+// check only the hashes sharing a block, otherwise I compare all pairs
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) PairsWithin(maxDistance int) [][2]uint32 {
+	live := func(hashIndex int) bool {
+		index, ok := h.hashesLookup[h.hashes[hashIndex].toKey()]
+		return ok && (index == uint32(hashIndex))
+	}
+	var pairs [][2]uint32
+	useMultiindex := h.config.UseMultiindex && (h.config.BlockOverlap == 0) && (h.config.MaxBucketScan == 0) &&
+		(maxDistance <= h.config.MaxDistance)
+	for hashIndex, hash := range h.hashes {
+		if !live(hashIndex) {
+			continue
+		}
+		if !useMultiindex {
+			for otherIndex := hashIndex + 1; otherIndex < len(h.hashes); otherIndex++ {
+				if live(otherIndex) && (h.hammingDistance(hash, h.hashes[otherIndex]) <= maxDistance) {
+					pairs = append(pairs, [2]uint32{uint32(hashIndex), uint32(otherIndex)})
+				}
+			}
+			continue
+		}
+		first := len(pairs)
+		h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+			if (candidateIndex > uint32(hashIndex)) && live(int(candidateIndex)) && (h.hammingDistance(hash, candidateHash) <= maxDistance) {
+				pairs = append(pairs, [2]uint32{uint32(hashIndex), candidateIndex})
+			}
+			return true
+		})
+		// The multi-index collects the candidates block by block
+		added := pairs[first:]
+		sort.Slice(added, func(i, j int) bool { return added[i][1] < added[j][1] })
+	}
+	return pairs
+}
+
+// Medoid returns the hash with the minimal sum of distances to all other
+// hashes in the set. Unlike a bitwise majority the medoid is a member of
+// the set. If several hashes have the same sum I return the first
+// I compare all pairs of hashes, this is O(N^2)
+func Medoid(hashes []FuzzyHash) (FuzzyHash, error) {
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("empty set")
+	}
+	if err := sameSize(hashes); err != nil {
+		return nil, err
+	}
+	sums := make([]int, len(hashes))
+	for i, hash := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			hammingDistance := distanceUint64s(hash, hashes[j])
+			sums[i] += hammingDistance
+			sums[j] += hammingDistance
+		}
+	}
+	medoid := 0
+	for i, sum := range sums {
+		if sum < sums[medoid] {
+			medoid = i
+		}
+	}
+	return hashes[medoid], nil
+}
+
+// SuggestMaxDistance picks random hashes in the DB, finds the distance to
+// the closest other hash and returns the 95th percentile of the distances
+// If the suggested distance is larger than MaxDistance the multi-index
+// misses most siblings
+// I compare a sample with all hashes in the DB, the multi-index does not
+// find siblings beyond MaxDistance
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) SuggestMaxDistance(samples int, seed int64) int {
+	var hashes []FuzzyHash
+	h.forEachHash(func(hash FuzzyHash) {
+		hashes = append(hashes, hash)
+	})
+	if (len(hashes) < 2) || (samples <= 0) {
+		return h.config.MaxDistance
+	}
+	random := rand.New(rand.NewSource(seed))
+	distances := make([]int, samples)
+	for i := range distances {
+		sample := random.Intn(len(hashes))
+		closest := h.config.HashSize
+		for j, hash := range hashes {
+			if j == sample {
+				continue
+			}
+			if hammingDistance := h.hammingDistance(hashes[sample], hash); hammingDistance < closest {
+				closest = hammingDistance
+			}
+		}
+		distances[i] = closest
+	}
+	sort.Ints(distances)
+	return distances[(len(distances)*95+99)/100-1]
+}
+
+// Rough cost of an entry in a Go map: a key, a value, a top hash byte
+// and the bucket overhead
+const mapEntryOverhead = 8
+
+// IndexMemoryByBlock returns an estimation of the memory used by every
+// table of the multi-index in bytes. I count the lists of hashes and the
+// map entries
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) IndexMemoryByBlock() []int {
+	memory := make([]int, h.blocks)
+	for b := range memory {
+		for _, hashes := range h.multiIndexTables[b] {
+			memory[b] += 2 + int(unsafe.Sizeof(hashes)) + mapEntryOverhead // uint16 key and a slice
+			memory[b] += 4 * cap(hashes)
+		}
+	}
+	return memory
+}
+
+// ApproxMemoryBytes returns an estimation of the memory used by the DB
+// in bytes: the hashes, the lookup map and the multi-index tables
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ApproxMemoryBytes() int {
+	var hash FuzzyHash
+	var key string
+	memory := cap(h.hashes) * int(unsafe.Sizeof(hash))
+	for _, hash := range h.hashes {
+		memory += 8 * cap(hash)
+	}
+	memory += len(h.hashesLookup) * (int(unsafe.Sizeof(key)) + 4 + mapEntryOverhead)
+	memory += len(h.duplicates) * (int(unsafe.Sizeof(key)) + 4 + mapEntryOverhead)
+	for _, blockMemory := range h.IndexMemoryByBlock() {
+		memory += blockMemory
+	}
+	return memory
+}
+
+// BitEntropy returns the Shannon entropy of every bit in the stored hashes
+// Entropy 0 means that the bit is the same in all hashes, entropy 1 means
+// that the bit is set in half of the hashes. Bit 0 is the least significant
+// bit of the hash. Low entropy bits do not help to tell the hashes apart
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) BitEntropy() []float64 {
+	ones := make([]int, h.config.HashSize)
+	count := 0
+	h.forEachHash(func(hash FuzzyHash) {
+		count++
+		for bit := range ones {
+			ones[bit] += int(hash.bitsAt(bit, 1))
+		}
+	})
+	entropy := make([]float64, h.config.HashSize)
+	if count == 0 {
+		return entropy
+	}
+	for bit, n := range ones {
+		p := float64(n) / float64(count)
+		if (p == 0) || (p == 1) {
+			continue
+		}
+		entropy[bit] = -p*math.Log2(p) - (1-p)*math.Log2(1-p)
+	}
+	return entropy
+}
@@ -0,0 +1,352 @@
+package hamming
+
+import (
+	"testing"
+)
+
+// clusteredDataSet generates 'clusters' random hashes and adds
+// 'clusterSize' hashes with at most 'maxDistance' bits changed around
+// every random hash
+func clusteredDataSet(h *H, clusters int, clusterSize int, maxDistance int, xs *XorShift1024Star) {
+	for c := 0; c < clusters; c++ {
+		center := randomFuzzyHash(h.config.HashSize, xs)
+		h.Add(center)
+		for i := 1; i < clusterSize; i++ {
+			fh := center.Dup()
+			for d := 0; d < maxDistance; d++ {
+				bit := xs.Uint64() % uint64(h.config.HashSize)
+				fh[bit/64] ^= uint64(1) << (bit % 64)
+			}
+			h.Add(fh)
+		}
+	}
+}
+
+func TestHammingSampleDistanceDistribution(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	clustered, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(clustered, 2, 100, 8, xs)
+	uniform, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 200; i++ {
+		uniform.Add(randomFuzzyHash(256, xs))
+	}
+
+	const samples = 1000
+	countShort := func(histogram []int) int {
+		total, short := 0, 0
+		for d, count := range histogram {
+			total += count
+			if d <= 16 {
+				short += count
+			}
+		}
+		if total != samples {
+			t.Errorf("Expected %d samples, got %d", samples, total)
+		}
+		return short
+	}
+	// Half of the pairs are in the same cluster
+	if short := countShort(clustered.SampleDistanceDistribution(samples, 1)); short < samples/3 {
+		t.Errorf("Expected clustered distances, got %d short distances out of %d", short, samples)
+	}
+	if short := countShort(uniform.SampleDistanceDistribution(samples, 1)); short != 0 {
+		t.Errorf("Expected uniform distances, got %d short distances out of %d", short, samples)
+	}
+
+	empty, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	if histogram := empty.SampleDistanceDistribution(samples, 1); len(histogram) != 257 {
+		t.Errorf("Expected 257 bins, got %d", len(histogram))
+	}
+}
+
+func TestHammingCandidateEfficiency(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	clustered, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(clustered, 20, 100, 8, xs)
+	uniform, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 2000; i++ {
+		uniform.Add(randomFuzzyHash(256, xs))
+	}
+
+	const queries = 100
+	averageEfficiency := func(h *H) float64 {
+		total := 0.0
+		for i := 0; i < queries; i++ {
+			// A close sibling of a random hash in the DB
+			query := h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+			query[0] ^= uint64(1) << (xs.Uint64() % 64)
+			total += h.CandidateEfficiency(query)
+		}
+		return total / queries
+	}
+	uniformEfficiency := averageEfficiency(uniform)
+	if uniformEfficiency > 0.05 {
+		t.Errorf("Expected low efficiency in the uniform set, got %f", uniformEfficiency)
+	}
+	clusteredEfficiency := averageEfficiency(clustered)
+	if clusteredEfficiency < 0.1 || clusteredEfficiency < 10*uniformEfficiency {
+		t.Errorf("Expected higher efficiency in the clustered set, got %f vs %f", clusteredEfficiency, uniformEfficiency)
+	}
+
+	empty, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	if efficiency := empty.CandidateEfficiency(randomFuzzyHash(256, xs)); efficiency != 0 {
+		t.Errorf("Expected 0 for an empty DB, got %f", efficiency)
+	}
+}
+
+func TestHammingMostCommon(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	var hashes []FuzzyHash
+	for i := 0; i < 5; i++ {
+		hashes = append(hashes, randomFuzzyHash(256, xs))
+	}
+	// Add hash 'i' multiplicities[i] times
+	multiplicities := []int{2, 5, 1, 3, 2}
+	for i, multiplicity := range multiplicities {
+		for m := 0; m < multiplicity; m++ {
+			h.Add(hashes[i].Dup())
+		}
+	}
+	for i, multiplicity := range multiplicities {
+		if occurrences := h.Occurrences(hashes[i]); occurrences != multiplicity {
+			t.Errorf("Hash %d: expected %d occurrences, got %d", i, multiplicity, occurrences)
+		}
+	}
+
+	// Ties keep the order of insertion
+	order := []int{1, 3, 0, 4, 2}
+	siblings := h.MostCommon(10)
+	if len(siblings) != len(order) {
+		t.Fatalf("Expected %d siblings, got %d", len(order), len(siblings))
+	}
+	for i, hashIndex := range order {
+		if !siblings[i].s.IsEqual(hashes[hashIndex]) || (siblings[i].distance != 0) {
+			t.Errorf("Position %d: expected hash %d, got %v", i, hashIndex, siblings[i])
+		}
+	}
+	if siblings = h.MostCommon(2); len(siblings) != 2 || !siblings[1].s.IsEqual(hashes[3]) {
+		t.Errorf("Expected two most common hashes, got %v", siblings)
+	}
+
+	h.RemoveBulk([]FuzzyHash{hashes[1]})
+	if occurrences := h.Occurrences(hashes[1]); occurrences != 0 {
+		t.Errorf("Expected no occurrences of the removed hash, got %d", occurrences)
+	}
+	h.Add(hashes[1])
+	if occurrences := h.Occurrences(hashes[1]); occurrences != 1 {
+		t.Errorf("Expected one occurrence of the added hash, got %d", occurrences)
+	}
+}
+
+func TestDiameter(t *testing.T) {
+	var hashes []FuzzyHash
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		hashes = append(hashes, fh)
+	}
+	// All zeros and 0x111111
+	expected := 6
+	diameter, err := Diameter(hashes)
+	if err != nil || diameter != expected {
+		t.Errorf("Expected diameter %d, got %d %v", expected, diameter, err)
+	}
+	sampled, err := DiameterSampled(hashes, 1000, 1)
+	if err != nil || sampled != expected {
+		t.Errorf("Expected sampled diameter %d, got %d %v", expected, sampled, err)
+	}
+	if sampled, _ = DiameterSampled(hashes, 1, 1); sampled > diameter {
+		t.Errorf("Sampled diameter %d exceeds %d", sampled, diameter)
+	}
+
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	if diameter, err = Diameter(append(hashes, fh)); err != nil || diameter != 256 {
+		t.Errorf("Expected diameter 256, got %d %v", diameter, err)
+	}
+	if diameter, err = Diameter(hashes[:1]); err != nil || diameter != 0 {
+		t.Errorf("Expected diameter 0 for one hash, got %d %v", diameter, err)
+	}
+	if _, err = Diameter(append(hashes, FuzzyHash{0x01})); err == nil {
+		t.Errorf("Expected an error for hashes of different sizes")
+	}
+	if _, err = DiameterSampled(append(hashes, FuzzyHash{0x01}), 10, 1); err == nil {
+		t.Errorf("Expected an error for hashes of different sizes")
+	}
+}
+
+func TestCompareIndices(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	a, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	b, _ := New(Config{HashSize: 256, MaxDistance: 20, UseMultiindex: true})
+	clusteredDataSet(a, 10, 100, 10, xs)
+	b.AddBulk(a.hashes)
+	if a.blocks == b.blocks {
+		t.Fatalf("Expected different block layouts")
+	}
+	var queries []FuzzyHash
+	for i := 0; i < 100; i++ {
+		distance := []int{0, 5, 20, 30, 100}[i%5]
+		queries = append(queries, PerturbHash(a.hashes[xs.Uint64()%uint64(len(a.hashes))], distance, int64(i)))
+	}
+	for i, difference := range CompareIndices(a, b, queries) {
+		if difference != 0 {
+			t.Errorf("Query %d: expected the same distance, got difference %d", i, difference)
+		}
+	}
+
+	// A hash missing in one of the DBs
+	query := randomFuzzyHash(256, xs)
+	a.Add(query)
+	if differences := CompareIndices(a, b, []FuzzyHash{query}); differences[0] != -21 {
+		t.Errorf("Expected difference -21, got %v", differences)
+	}
+}
+
+func TestHammingPairsWithin(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 50; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		// A cluster of hashes 0, 50, 51, 52
+		h.Add(PerturbHash(h.hashes[0], 3, 1))
+		h.Add(PerturbHash(h.hashes[0], 5, 2))
+		h.Add(PerturbHash(h.hashes[50], 4, 3))
+		expected := [][2]uint32{{0, 50}, {0, 51}, {0, 52}, {50, 51}, {50, 52}, {51, 52}}
+		// 36 bits is beyond MaxDistance, I compare all pairs
+		for _, maxDistance := range []int{20, 36} {
+			pairs := h.PairsWithin(maxDistance)
+			if len(pairs) != len(expected) {
+				t.Fatalf("Multiindex %v distance %d: expected %v, got %v", useMultiindex, maxDistance, expected, pairs)
+			}
+			for i := range pairs {
+				if pairs[i] != expected[i] {
+					t.Errorf("Multiindex %v distance %d: expected %v, got %v", useMultiindex, maxDistance, expected, pairs)
+					break
+				}
+			}
+		}
+		if pairs := h.PairsWithin(2); len(pairs) != 0 {
+			t.Errorf("Multiindex %v: expected no pairs, got %v", useMultiindex, pairs)
+		}
+	}
+}
+
+func TestMedoid(t *testing.T) {
+	var hashes []FuzzyHash
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		hashes = append(hashes, fh)
+	}
+	// 0x0, 0x1, 0x11, ..., 0x111111 - the sum is minimal for 0x111
+	medoid, err := Medoid(hashes)
+	if err != nil || !medoid.IsEqual(FuzzyHash{0x00, 0x00, 0x00, 0x111}) {
+		t.Errorf("Expected medoid 0x111, got %s %v", medoid.ToString(), err)
+	}
+	if medoid, _ = Medoid(hashes[:1]); !medoid.IsEqual(hashes[0]) {
+		t.Errorf("Expected the only member, got %s", medoid.ToString())
+	}
+	if _, err = Medoid(nil); err == nil {
+		t.Errorf("Expected an error for an empty set")
+	}
+	if _, err = Medoid(append(hashes, FuzzyHash{0x01})); err == nil {
+		t.Errorf("Expected an error for hashes of different sizes")
+	}
+}
+
+func TestHammingSuggestMaxDistance(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	clustered, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	// Up to 16 bits between two hashes in the same cluster
+	clusteredDataSet(clustered, 10, 50, 8, xs)
+	if suggestion := clustered.SuggestMaxDistance(100, 1); (suggestion <= 0) || (suggestion > 16) {
+		t.Errorf("Expected up to 16 bits for the clustered set, got %d", suggestion)
+	}
+	uniform, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 500; i++ {
+		uniform.Add(randomFuzzyHash(256, xs))
+	}
+	if suggestion := uniform.SuggestMaxDistance(100, 1); suggestion <= 35 {
+		t.Errorf("Expected more than 35 bits for the uniform set, got %d", suggestion)
+	}
+	empty, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	if suggestion := empty.SuggestMaxDistance(100, 1); suggestion != 35 {
+		t.Errorf("Expected MaxDistance for an empty set, got %d", suggestion)
+	}
+}
+
+func TestHammingIndexMemoryByBlock(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 5000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	memory := h.IndexMemoryByBlock()
+	if len(memory) != 36 {
+		t.Fatalf("Expected 36 blocks, got %d", len(memory))
+	}
+	indexMemory := 0
+	for b, blockMemory := range memory {
+		// 5000 hashes in 128 buckets of 7 bits, 4 bytes per hash
+		if blockMemory < 5000*4 {
+			t.Errorf("Block %d: expected at least %d bytes, got %d", b, 5000*4, blockMemory)
+		}
+		indexMemory += blockMemory
+	}
+	// The last block is 11 bits, it has more buckets
+	if memory[35] <= memory[0] {
+		t.Errorf("Expected a larger last block, got %d and %d", memory[35], memory[0])
+	}
+	total := h.ApproxMemoryBytes()
+	hashesMemory := 5000 * (32 + 24)
+	if (total < indexMemory+hashesMemory) || (total > 2*(indexMemory+hashesMemory)) {
+		t.Errorf("Expected roughly %d bytes, got %d", indexMemory+hashesMemory, total)
+	}
+
+	bruteForce, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: false})
+	bruteForce.AddBulk(h.hashes)
+	for b, blockMemory := range bruteForce.IndexMemoryByBlock() {
+		if blockMemory != 0 {
+			t.Errorf("Block %d: expected no memory, got %d", b, blockMemory)
+		}
+	}
+}
+
+func TestHammingBitEntropy(t *testing.T) {
+	h, _ := New(Config{HashSize: 128, MaxDistance: 7, UseMultiindex: true})
+	if entropy := h.BitEntropy(); len(entropy) != 128 || entropy[0] != 0 {
+		t.Errorf("Expected zeros for an empty DB, got %v", entropy)
+	}
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 1000; i++ {
+		hash := randomFuzzyHash(128, xs)
+		hash[1] |= 0x01     // bit 0 is always set
+		hash[0] &^= 1 << 63 // bit 127 is always clear
+		hash[1] &^= 0x02    // bit 1 is set in every other hash
+		if i%2 == 0 {
+			hash[1] |= 0x02
+		}
+		h.Add(hash)
+	}
+	entropy := h.BitEntropy()
+	if entropy[0] != 0 || entropy[127] != 0 {
+		t.Errorf("Expected entropy 0 for the constant bits, got %f and %f", entropy[0], entropy[127])
+	}
+	if entropy[1] != 1 {
+		t.Errorf("Expected entropy 1 for the balanced bit, got %f", entropy[1])
+	}
+	for bit := 2; bit < 127; bit++ {
+		if entropy[bit] < 0.95 {
+			t.Errorf("Bit %d: expected entropy ~1 for a random bit, got %f", bit, entropy[bit])
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package hamming
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// FrozenH is a read only version of H optimized for lookups
+// I keep all hashes in one contiguous array and all index tables in sorted
+// arrays, there are no maps. FrozenH consumes less memory and
+// causes less data cache misses than H
+// Many threads can call FrozenH APIs simultaneously
+type FrozenH struct {
+	config Config
+	blockLayout
+	words int
+
+	// Hash 'i' is hashes[i*words:(i+1)*words]
+	hashes []uint64
+	count  int
+
+	// The indexes of the hashes sorted by the hash value. I find an exact
+	// match with a binary search
+	sorted []uint32
+
+	// One table for every block
+	tables []frozenTable
+
+	// The order of the blocks in the search, see Config.ReorderBlocks
+	blockOrder []int
+
+	// Without the multi-index I check bruteForceLimit hashes, see
+	// Config.MaxCandidates
+	bruteForceLimit       int
+	bruteForceApproximate bool
+
+	scratchPool *sync.Pool
+
+	// Config.RandomizeTies, many threads share the generator
+	random      *rand.Rand
+	randomMutex sync.Mutex
+
+	// Debug counters, see Stats()
+	statistics *Statistics
+}
+
+// frozenTable is an index table which keeps the lists of hashes one after
+// another. The hashes containing the block value values[i] are
+// postings[offsets[i]:offsets[i+1]]
+type frozenTable struct {
+	values   []uint16
+	offsets  []uint32
+	postings []uint32
+}
+
+// Freeze converts the DB into a read only form
+// The frozen DB returns the same siblings as the original DB. The frozen
+// DB follows MaxCandidates, MaxBucketScan, the order of the blocks and
+// TieBreaker of the original DB. With RandomizeTies the frozen DB picks
+// the ties with own random generator seeded by TiesSeed
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) Freeze() *FrozenH {
+	words := h.config.words()
+	fh := &FrozenH{
+		config:      h.config,
+		blockLayout: h.blockLayout,
+		words:       words,
+		hashes:      make([]uint64, 0, words*len(h.hashesLookup)),
+		blockOrder:  h.blockOrder, // I never modify the order in place
+		scratchPool: &sync.Pool{New: newQueryScratch},
+		statistics:  &Statistics{},
+	}
+	if h.config.RandomizeTies {
+		fh.random = rand.New(rand.NewSource(h.config.TiesSeed))
+	}
+	for _, hash := range h.hashes {
+		if hash == nil { // removed
+			continue
+		}
+		fh.hashes = append(fh.hashes, hash...)
+	}
+	fh.count = len(fh.hashes) / words
+	fh.bruteForceLimit = fh.count
+	if (h.config.MaxCandidates > 0) && (fh.count > h.config.MaxCandidates) {
+		fh.bruteForceLimit = h.config.MaxCandidates
+		fh.bruteForceApproximate = true
+	}
+	fh.sorted = make([]uint32, fh.count)
+	for i := range fh.sorted {
+		fh.sorted[i] = uint32(i)
+	}
+	sort.Slice(fh.sorted, func(i, j int) bool {
+		return fh.hash(fh.sorted[i]).less(fh.hash(fh.sorted[j]))
+	})
+	if !h.config.UseMultiindex {
+		return fh
+	}
+
+	type posting struct {
+		blockValue uint16
+		hashIndex  uint32
+	}
+	postings := make([][]posting, h.blocks)
+	var buffer [256]uint16
+	for hashIndex := 0; hashIndex < fh.count; hashIndex++ {
+		blockValues := h.blockValues(fh.hash(uint32(hashIndex)), buffer[:0])
+		for b, blockValue := range blockValues {
+			postings[b] = append(postings[b], posting{blockValue: blockValue, hashIndex: uint32(hashIndex)})
+		}
+	}
+	fh.tables = make([]frozenTable, h.blocks)
+	for b, blockPostings := range postings {
+		// The hash indexes are already sorted
+		sort.SliceStable(blockPostings, func(i, j int) bool {
+			return blockPostings[i].blockValue < blockPostings[j].blockValue
+		})
+		table := &fh.tables[b]
+		table.postings = make([]uint32, len(blockPostings))
+		for i, p := range blockPostings {
+			if (i == 0) || (p.blockValue != blockPostings[i-1].blockValue) {
+				table.values = append(table.values, p.blockValue)
+				table.offsets = append(table.offsets, uint32(i))
+			}
+			table.postings[i] = p.hashIndex
+		}
+		table.offsets = append(table.offsets, uint32(len(blockPostings)))
+	}
+	return fh
+}
+
+func (fh *FrozenH) hash(hashIndex uint32) FuzzyHash {
+	start := int(hashIndex) * fh.words
+	return fh.hashes[start : start+fh.words : start+fh.words]
+}
+
+// contains returns true if the hash is in the frozen DB
+func (fh *FrozenH) contains(hash FuzzyHash) bool {
+	i := sort.Search(len(fh.sorted), func(i int) bool { return !fh.hash(fh.sorted[i]).less(hash) })
+	return (i < len(fh.sorted)) && fh.hash(fh.sorted[i]).IsEqual(hash)
+}
+
+// Count returns number of hashes in the frozen DB
+func (fh *FrozenH) Count() int {
+	return fh.count
+}
+
+// Stats returns the counters of the frozen DB. The frozen DB starts
+// with zero counters
+// Many threads can call the API simultaneously
+func (fh *FrozenH) Stats() Statistics {
+	return fh.statistics.snapshot(false)
+}
+
+// ShortestDistance returns the closest sibling in the frozen DB for
+// the specfied hash
+func (fh *FrozenH) ShortestDistance(hash FuzzyHash) Sibling {
+	atomic.AddUint64(&fh.statistics.Distance, 1)
+	sibling := Sibling{
+		distance: fh.config.HashSize,
+	}
+	if (len(hash) == 0) || (len(hash) != fh.words) {
+		return sibling
+	}
+	hash = hash.maskPadding(fh.config.HashSize)
+	// Like H I do not check the candidates for an exact match
+	if fh.contains(hash) {
+		atomic.AddUint64(&fh.statistics.DistanceContains, 1)
+		atomic.AddUint64(&fh.statistics.ExactMatches, 1)
+		return Sibling{distance: 0, s: hash}
+	}
+
+	popcountMode := fh.config.PopcountMode
+	ties := 0
+	check := func(candidateHash FuzzyHash) {
+		hammingDistance := popcountMode.distance(hash, candidateHash)
+		if hammingDistance < sibling.distance {
+			ties = 1
+			sibling = Sibling{s: candidateHash, distance: hammingDistance}
+		} else if hammingDistance == sibling.distance {
+			ties++
+			if fh.breakTie(candidateHash, sibling.s, ties) {
+				sibling = Sibling{s: candidateHash, distance: hammingDistance}
+			}
+		}
+	}
+	if !fh.config.UseMultiindex {
+		for hashIndex := 0; hashIndex < fh.bruteForceLimit; hashIndex++ {
+			check(fh.hash(uint32(hashIndex)))
+		}
+		if fh.bruteForceApproximate {
+			sibling.approximate = true
+			atomic.AddUint64(&fh.statistics.DistanceApproximate, 1)
+		}
+		return sibling
+	}
+
+	scratch := fh.scratchPool.Get().(*queryScratch)
+	defer fh.scratchPool.Put(scratch)
+	if len(scratch.checkedCandidates) < fh.count {
+		scratch.checkedCandidates = make([]uint32, fh.count)
+		scratch.generation = 0
+	}
+	scratch.generation++
+	if scratch.generation == 0 {
+		for i := range scratch.checkedCandidates {
+			scratch.checkedCandidates[i] = 0
+		}
+		scratch.generation = 1
+	}
+	checkedCandidates, generation := scratch.checkedCandidates, scratch.generation
+
+	var buffer [256]uint16
+	blockValues := fh.blockValues(hash, buffer[:0])
+	candidates := 0
+search:
+	for i := range blockValues {
+		b := i
+		if fh.blockOrder != nil {
+			b = fh.blockOrder[i]
+		}
+		blockValue := blockValues[b]
+		table := &fh.tables[b]
+		v := sort.Search(len(table.values), func(v int) bool { return table.values[v] >= blockValue })
+		if (v == len(table.values)) || (table.values[v] != blockValue) {
+			continue
+		}
+		bucket := table.postings[table.offsets[v]:table.offsets[v+1]]
+		if (fh.config.MaxBucketScan > 0) && (len(bucket) > fh.config.MaxBucketScan) {
+			atomic.AddUint64(&fh.statistics.DistanceSkippedBuckets, 1)
+			continue
+		}
+		for _, candidateIndex := range bucket {
+			if checkedCandidates[candidateIndex] == generation {
+				continue
+			}
+			checkedCandidates[candidateIndex] = generation
+			if (fh.config.MaxCandidates > 0) && (candidates == fh.config.MaxCandidates) {
+				sibling.approximate = true
+				atomic.AddUint64(&fh.statistics.DistanceApproximate, 1)
+				break search
+			}
+			candidates++
+			check(fh.hash(candidateIndex))
+		}
+	}
+	return sibling
+}
+
+// breakTie returns true if the candidate replaces the sibling at the same
+// distance, see Config.TieBreaker and Config.RandomizeTies
+func (fh *FrozenH) breakTie(candidate, current FuzzyHash, ties int) bool {
+	if fh.config.TieBreaker != nil {
+		return (current != nil) && fh.config.TieBreaker(candidate, current)
+	}
+	if fh.config.RandomizeTies {
+		fh.randomMutex.Lock()
+		pick := fh.random.Intn(ties) == 0
+		fh.randomMutex.Unlock()
+		return pick
+	}
+	return (current != nil) && candidate.less(current)
+}
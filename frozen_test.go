@@ -0,0 +1,124 @@
+package hamming
+
+import (
+	"testing"
+)
+
+func TestHammingFreeze(t *testing.T) {
+	configs := []Config{
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: false},
+		{HashSize: 256, MaxDistance: 15, UseMultiindex: true, BlockOverlap: 4},
+		{HashSize: 192, MaxDistance: 20, UseMultiindex: true, PopcountMode: PopcountTable},
+	}
+	for _, config := range configs {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, err := New(config)
+		if err != nil {
+			t.Fatalf("Failed to create H for %+v: %v", config, err)
+		}
+		clusteredDataSet(h, 10, 50, 10, xs)
+		fh := h.Freeze()
+		if fh.Count() != h.Count() {
+			t.Errorf("Config %+v: expected %d hashes, got %d", config, h.Count(), fh.Count())
+		}
+
+		for i := 0; i < 1000; i++ {
+			var query FuzzyHash
+			if i%2 == 0 {
+				query = h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+				query[0] ^= xs.Uint64() & xs.Uint64()
+			} else {
+				query = randomFuzzyHash(64*config.words(), xs)
+			}
+			expected := h.ShortestDistance(query)
+			sibling := fh.ShortestDistance(query)
+			if sibling.distance != expected.distance {
+				t.Fatalf("Config %+v: expected distance %d, got %d for %s", config, expected.distance, sibling.distance, query.ToString())
+			}
+			if (sibling.distance < config.HashSize) && (distanceUint64s(query, sibling.s) != sibling.distance) {
+				t.Fatalf("Config %+v: sibling %s is not at distance %d", config, sibling.s.ToString(), sibling.distance)
+			}
+		}
+
+		if sibling := fh.ShortestDistance(FuzzyHash{1}); sibling.distance != config.HashSize {
+			t.Errorf("Config %+v: expected no sibling for a bad hash, got %v", config, sibling)
+		}
+	}
+}
+
+func TestHammingFreezeConfig(t *testing.T) {
+	higher := func(a, b FuzzyHash) bool { return b.less(a) }
+	configs := []Config{
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true, MaxCandidates: 3},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: false, MaxCandidates: 3},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: false, MaxCandidates: 300},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true, MaxBucketScan: 1},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ReorderBlocks: true, MaxCandidates: 20},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true, TieBreaker: higher},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: false, TieBreaker: higher},
+	}
+	for configID, config := range configs {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(config)
+		var hashes []FuzzyHash
+		for i := 0; i < 500; i++ {
+			hash := randomFuzzyHash(256, xs)
+			// Many ties and large buckets
+			hash[0] &= 0xFF
+			hash[1] &= 0xFF
+			hashes = append(hashes, hash)
+		}
+		h.AddBulk(hashes)
+		h.RemoveBulk([]FuzzyHash{h.hashes[0], h.hashes[100]})
+		fh := h.Freeze()
+		for i := 0; i < 200; i++ {
+			query := PerturbHash(h.hashes[1+xs.Uint64()%uint64(len(h.hashes)-1)], 1+i%20, int64(i))
+			if i%4 == 0 {
+				query = randomFuzzyHash(256, xs)
+			}
+			// MaxBucketScan and MaxCandidates do not hide an exact match
+			if i%4 == 1 {
+				query = h.hashes[101+xs.Uint64()%uint64(len(h.hashes)-101)]
+			}
+			expected, sibling := h.ShortestDistance(query), fh.ShortestDistance(query)
+			if !sibling.isEqual(expected) || (sibling.approximate != expected.approximate) {
+				t.Fatalf("Config %d: query %d: expected %d %v, got %d %v", configID, i, expected.distance, expected.approximate, sibling.distance, sibling.approximate)
+			}
+		}
+	}
+}
+
+func benchmarkFreeze(setSize int, frozen bool, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < setSize; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	queries := make([]FuzzyHash, 1024)
+	for i := range queries {
+		queries[i] = h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+		queries[i][0] &= xs.Uint64()
+	}
+	fh := h.Freeze()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if frozen {
+			fh.ShortestDistance(queries[i%len(queries)])
+		} else {
+			h.ShortestDistance(queries[i%len(queries)])
+		}
+	}
+}
+
+func BenchmarkFreezeH(b *testing.B) {
+	benchmarkFreeze(100*1000, false, b)
+}
+
+func BenchmarkFreezeFrozenH(b *testing.B) {
+	benchmarkFreeze(100*1000, true, b)
+}
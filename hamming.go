@@ -17,20 +17,29 @@ package hamming
 
 import (
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"math/big"
 	"math/bits"
+	"math/rand"
 	"reflect"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 	// For Combinations: go get -u -t gonum.org/v1/gonum/...
 	// "gonum.org/v1/gonum/stat/combin"
 )
 
-// Statistics keeps all global debug counters and performance
-// monitors
+// Statistics keeps the debug counters and performance monitors of
+// an instance of H
+// The distance APIs can run in many threads and update the counters
+// atomically
 type Statistics struct {
-	PendingDistance         uint64 // intentionally not atomic
+	PendingDistance         uint64
 	Distance                uint64
 	DistanceContains        uint64
 	DistanceCandidates      uint64
@@ -38,10 +47,25 @@ type Statistics struct {
 	DistanceNoIndex         uint64
 	DistanceNoCandidates    uint64
 	DistanceAlreadyChecked  uint64
+	DistanceApproximate     uint64
+	DistanceSkippedBuckets  uint64
+
+	// The results of ShortestDistance() by distance. A growing share of
+	// the queries beyond MaxDistance means that the data drifts
+	ExactMatches    uint64 // distance 0
+	WithinThreshold uint64 // distance is 1..MaxDistance
+	BeyondThreshold uint64 // no sibling within MaxDistance
+
+	// The largest number of candidates a multi-index query checked
+	MaxCandidatesSeen uint64
+
+	ContainsWithin           uint64
+	ContainsWithinCandidates uint64 // examined before the early exit
 
 	AddIndex        uint64
 	AddIndexExists  uint64
 	AddIndexExists1 uint64
+	AddIndexBadHash uint64
 
 	RemoveIndex          uint64
 	RemoveIndexNotFound  uint64
@@ -50,11 +74,61 @@ type Statistics struct {
 	RemoveIndexNotFound3 uint64
 }
 
-var statistics = &Statistics{}
+// snapshot loads all counters atomically. If reset is true I zero the
+// counters. PendingDistance is the number of running queries, I never
+// reset it
+func (s *Statistics) snapshot(reset bool) Statistics {
+	load := func(counter *uint64) uint64 {
+		if reset {
+			return atomic.SwapUint64(counter, 0)
+		}
+		return atomic.LoadUint64(counter)
+	}
+	return Statistics{
+		PendingDistance:         atomic.LoadUint64(&s.PendingDistance),
+		Distance:                load(&s.Distance),
+		DistanceContains:        load(&s.DistanceContains),
+		DistanceCandidates:      load(&s.DistanceCandidates),
+		DistanceBetterCandidate: load(&s.DistanceBetterCandidate),
+		DistanceNoIndex:         load(&s.DistanceNoIndex),
+		DistanceNoCandidates:    load(&s.DistanceNoCandidates),
+		DistanceAlreadyChecked:  load(&s.DistanceAlreadyChecked),
+		DistanceApproximate:     load(&s.DistanceApproximate),
+		DistanceSkippedBuckets:  load(&s.DistanceSkippedBuckets),
+
+		ExactMatches:      load(&s.ExactMatches),
+		WithinThreshold:   load(&s.WithinThreshold),
+		BeyondThreshold:   load(&s.BeyondThreshold),
+		MaxCandidatesSeen: load(&s.MaxCandidatesSeen),
+
+		ContainsWithin:           load(&s.ContainsWithin),
+		ContainsWithinCandidates: load(&s.ContainsWithinCandidates),
+
+		AddIndex:        load(&s.AddIndex),
+		AddIndexExists:  load(&s.AddIndexExists),
+		AddIndexExists1: load(&s.AddIndexExists1),
+		AddIndexBadHash: load(&s.AddIndexBadHash),
+
+		RemoveIndex:          load(&s.RemoveIndex),
+		RemoveIndexNotFound:  load(&s.RemoveIndexNotFound),
+		RemoveIndexNotFound1: load(&s.RemoveIndexNotFound1),
+		RemoveIndexNotFound2: load(&s.RemoveIndexNotFound2),
+		RemoveIndexNotFound3: load(&s.RemoveIndexNotFound3),
+	}
+}
+
+// The counters of the instance New() created last, see GetStatistics()
+var lastStatistics atomic.Value
 
 // GetStatistics access debug statistics
+// Deprecated: the counters are per instance, use H.Stats(). I return the
+// counters of the instance New() created last
 func GetStatistics() Statistics {
-	return *statistics
+	statistics, ok := lastStatistics.Load().(*Statistics)
+	if !ok {
+		return Statistics{}
+	}
+	return statistics.snapshot(false)
 }
 
 // FuzzyHash uses 64 bits words instead of bytes because I "know"
@@ -66,6 +140,9 @@ type FuzzyHash []uint64
 type Sibling struct {
 	s        FuzzyHash
 	distance int
+
+	// The search hit Config.MaxCandidates
+	approximate bool
 }
 
 func (s Sibling) isEqual(s1 Sibling) bool {
@@ -82,13 +159,28 @@ func (s Sibling) Distance() int {
 	return s.distance
 }
 
+// Approximate returns true if the search stopped after Config.MaxCandidates
+// candidates. There can be a closer sibling in the DB
+func (s Sibling) Approximate() bool {
+	return s.approximate
+}
+
 // ToString turns []FuzzyHash{0x00} into "0000000000000000"
 func (fh FuzzyHash) ToString() string {
-	var buffer bytes.Buffer
+	return string(fh.AppendHex(make([]byte, 0, 16*len(fh))))
+}
+
+const hexDigits = "0123456789abcdef"
+
+// AppendHex appends the ToString() representation of the hash to dst
+// and returns the extended buffer. I do not allocate if dst has capacity
+func (fh FuzzyHash) AppendHex(dst []byte) []byte {
 	for _, v := range fh {
-		buffer.WriteString(fmt.Sprintf("%016x", v))
+		for shift := 60; shift >= 0; shift -= 4 {
+			dst = append(dst, hexDigits[(v>>uint(shift))&0xF])
+		}
 	}
-	return buffer.String()
+	return dst
 }
 
 /*
@@ -119,6 +211,12 @@ func (fh FuzzyHash) toKey() (s string) {
 	return s
 }
 
+// appendKey appends the bytes of the key to the buffer
+// string(appendKey(buffer, fh)) is a key which does not alias the hash
+func appendKey(dst []byte, fh FuzzyHash) []byte {
+	return append(dst, fh.toKey()...)
+}
+
 // IsEqual compares two hashes
 func (fh FuzzyHash) IsEqual(other FuzzyHash) bool {
 	if len(fh) != len(other) {
@@ -132,7 +230,102 @@ func (fh FuzzyHash) IsEqual(other FuzzyHash) bool {
 	return true
 }
 
+// IsZero returns true if all bits of the hash are zero
+func (fh FuzzyHash) IsZero() bool {
+	for _, e := range fh {
+		if e != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Split returns the hash cut into 'parts' hashes of the same size. The
+// first part keeps the first (most significant) words. The parts are copies
+func (fh FuzzyHash) Split(parts int) ([]FuzzyHash, error) {
+	if (parts <= 0) || (len(fh)%parts != 0) {
+		return nil, fmt.Errorf("can not split %d words into %d parts", len(fh), parts)
+	}
+	words := len(fh) / parts
+	result := make([]FuzzyHash, parts)
+	for i := range result {
+		result[i] = fh[i*words : (i+1)*words].Dup()
+	}
+	return result, nil
+}
+
+// EqualPadded compares two hashes of different sizes. I zero extend the
+// shorter hash. The first word is the most significant, the padding words
+// go first
+func (fh FuzzyHash) EqualPadded(other FuzzyHash) bool {
+	if len(fh) < len(other) {
+		fh, other = other, fh
+	}
+	padding := len(fh) - len(other)
+	for i, e := range fh {
+		if i < padding {
+			if e != 0 {
+				return false
+			}
+			continue
+		}
+		if e != other[i-padding] {
+			return false
+		}
+	}
+	return true
+}
+
+// Bits returns size of the hash in bits
+func (fh FuzzyHash) Bits() int {
+	return 64 * len(fh)
+}
+
+// LeadingZeros returns number of leading zero bits in the hash
+// The first item in the array is the most significant
+func (fh FuzzyHash) LeadingZeros() int {
+	zeros := 0
+	for _, v := range fh {
+		zeros += bits.LeadingZeros64(v)
+		if v != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// Comparable returns true if the hashes are of the same size. Distance()
+// and Xor() fail if the hashes are not comparable
+func (fh FuzzyHash) Comparable(other FuzzyHash) bool {
+	return len(fh) == len(other)
+}
+
+// Xor returns a new hash of the bits which differ in the hashes
+// The hashes shall be of the same size
+func (fh FuzzyHash) Xor(other FuzzyHash) (FuzzyHash, error) {
+	if !fh.Comparable(other) {
+		return nil, fmt.Errorf("hash is %d bits, expected %d bits", other.Bits(), fh.Bits())
+	}
+	xor := make(FuzzyHash, len(fh))
+	for i := range fh {
+		xor[i] = fh[i] ^ other[i]
+	}
+	return xor, nil
+}
+
+// PopCount returns number of set bits in the hash
+func (fh FuzzyHash) PopCount() int {
+	count := 0
+	for _, v := range fh {
+		count += bits.OnesCount64(v)
+	}
+	return count
+}
+
 func (fh FuzzyHash) and(mask uint64) uint64 {
+	if len(fh) == 0 {
+		return 0
+	}
 	last := len(fh) - 1
 	return fh[last] & mask
 }
@@ -156,6 +349,148 @@ func (fh FuzzyHash) rsh(s uint64) {
 	return
 }
 
+// Lsh shifts the hash left by s bits, the mirror of rsh()
+// The bits shifted out of the first item are lost. I support any s, a shift
+// by the size of the hash or more clears the hash
+func (fh FuzzyHash) Lsh(s uint64) {
+	const _W uint64 = 64
+	if s == 0 {
+		return
+	}
+	if len(fh) == 0 {
+		return
+	}
+	if s >= _W*uint64(len(fh)) {
+		for i := range fh {
+			fh[i] = 0
+		}
+		return
+	}
+	if words := int(s / _W); words > 0 {
+		copy(fh, fh[words:])
+		for i := len(fh) - words; i < len(fh); i++ {
+			fh[i] = 0
+		}
+	}
+	s &= _W - uint64(1)
+	if s == 0 {
+		return
+	}
+	ŝ := _W - s
+	for i := 0; i < len(fh)-1; i++ { // most significant item is the first in the array
+		fh[i] = fh[i]<<s | fh[i+1]>>ŝ
+	}
+	fh[len(fh)-1] = fh[len(fh)-1] << s
+}
+
+// GetBit returns the value of the bit 'i', 0 or 1
+// Bit 0 is the least significant bit of the last item in the array
+// The bit accessors panic if the bit is out of range
+func (fh FuzzyHash) GetBit(i int) int {
+	return int(fh[len(fh)-1-i/64]>>uint(i%64)) & 1
+}
+
+// SetBit sets the bit 'i'
+func (fh FuzzyHash) SetBit(i int) {
+	fh[len(fh)-1-i/64] |= uint64(1) << uint(i%64)
+}
+
+// FlipBit inverts the bit 'i'
+func (fh FuzzyHash) FlipBit(i int) {
+	fh[len(fh)-1-i/64] ^= uint64(1) << uint(i%64)
+}
+
+// bitsAt returns 'size' bits starting from bit 'offset'
+// Bit 0 is the least significant bit of the last item in the array
+// Size is up to 64 bits, the bits can span two items
+func (fh FuzzyHash) bitsAt(offset int, size int) uint64 {
+	word := len(fh) - 1 - offset/64
+	shift := uint(offset % 64)
+	value := fh[word] >> shift
+	if (shift+uint(size) > 64) && (word > 0) {
+		value |= fh[word-1] << (64 - shift)
+	}
+	if size < 64 {
+		value &= (uint64(1) << uint(size)) - 1
+	}
+	return value
+}
+
+// BlockPopcounts returns number of set bits in every block of the hash
+// Block 0 is the least significant bits of the hash like in the
+// multi-index. The last block is shorter if blockSize does not divide
+// the size of the hash. I return nil if blockSize is not positive
+func (fh FuzzyHash) BlockPopcounts(blockSize int) []int {
+	if blockSize <= 0 {
+		return nil
+	}
+	bitsCount := fh.Bits()
+	popcounts := make([]int, 0, (bitsCount+blockSize-1)/blockSize)
+	for start := 0; start < bitsCount; start += blockSize {
+		end := start + blockSize
+		if end > bitsCount {
+			end = bitsCount
+		}
+		count := 0
+		for offset := start; offset < end; offset += 64 {
+			size := end - offset
+			if size > 64 {
+				size = 64
+			}
+			count += bits.OnesCount64(fh.bitsAt(offset, size))
+		}
+		popcounts = append(popcounts, count)
+	}
+	return popcounts
+}
+
+// DistanceRange returns the hamming distance between the bits
+// [startBit, endBit) of two hashes. Bit 0 is the least significant bit of
+// the last item in the array
+// Use it for hashes which concatenate independent hashes
+func (fh FuzzyHash) DistanceRange(other FuzzyHash, startBit, endBit int) (int, error) {
+	if len(fh) != len(other) {
+		return 0, fmt.Errorf("hashes are %d and %d bits", fh.Bits(), other.Bits())
+	}
+	if (startBit < 0) || (endBit > fh.Bits()) || (startBit > endBit) {
+		return 0, fmt.Errorf("bad range %d-%d for %d bits", startBit, endBit, fh.Bits())
+	}
+	distance := 0
+	for offset := startBit; offset < endBit; offset += 64 {
+		size := endBit - offset
+		if size > 64 {
+			size = 64
+		}
+		distance += bits.OnesCount64(fh.bitsAt(offset, size) ^ other.bitsAt(offset, size))
+	}
+	return distance, nil
+}
+
+// paddingMask returns the bits of the first word which are outside
+// of the hash of the specified size
+func (fh FuzzyHash) paddingMask(bits int) uint64 {
+	usedBits := bits - 64*(len(fh)-1)
+	if (len(fh) == 0) || (usedBits >= 64) || (usedBits <= 0) {
+		return 0
+	}
+	return ^((uint64(1) << uint(usedBits)) - 1)
+}
+
+func (fh FuzzyHash) hasPadding(bits int) bool {
+	return (len(fh) > 0) && (fh[0]&fh.paddingMask(bits) != 0)
+}
+
+// maskPadding returns a hash with all bits beyond the specified size cleared
+// I allocate a new hash only if there are bits to clear
+func (fh FuzzyHash) maskPadding(bits int) FuzzyHash {
+	if !fh.hasPadding(bits) {
+		return fh
+	}
+	fh = fh.Dup()
+	fh[0] &^= fh.paddingMask(bits)
+	return fh
+}
+
 // Dup allocates a new hash and copies the data
 func (fh FuzzyHash) Dup() FuzzyHash {
 	tmp := make([]uint64, len(fh))
@@ -174,7 +509,10 @@ type indexTable map[uint16]([]uint32)
 // a separate structure. Another upside is that it simpleifies testing
 // of different configurations
 type Config struct {
-	HashSize    int // For example, 256 bits
+	// For example, 256 bits. If the size is not a multiple of 64 bits
+	// the most significant bits of the first word are padding. I zero
+	// the padding bits of all hashes entering the DB
+	HashSize    int
 	MaxDistance int // 35 bits
 
 	// Use 'false' for faster lookup
@@ -190,11 +528,87 @@ type Config struct {
 	// Single stage brute force approach which calculates all hamming
 	// distances is faster in the tests.
 	UseMultiindex bool
+
+	// Number of bits shared by two adjacent blocks in the multi-index
+	// Zero (default) means disjoint blocks. Overlapping blocks find more
+	// siblings beyond MaxDistance for the price of a larger index
+	// A bit belongs to up to ceil(blockSize/(blockSize-BlockOverlap))
+	// blocks. A sibling is guaranteed to be found if the number of blocks
+	// is larger than the distance multiplied by this number
+	BlockOverlap int
+
+	// Default is bits.OnesCount64() which is the fastest on modern CPUs
+	PopcountMode PopcountMode
+
+	// The maximum number of candidates ShortestDistance checks. Zero
+	// (default) means no limit. A limit bounds the query latency when
+	// the query hits a huge bucket, the result is approximate
+	MaxCandidates int
+
+	// Expected number of hashes in the DB. I allocate the tables for the
+	// expected number of hashes in New() and avoid rehashing of the maps
+	// during the load. Zero (default) means no preallocation
+	ExpectedCount int
+
+	// ShortestDistance calls OnSlowQuery if the query checks more than
+	// SlowQueryThreshold candidates. Zero (default) threshold disables
+	// the callback. Many threads can call OnSlowQuery simultaneously
+	SlowQueryThreshold int
+	OnSlowQuery        func(query FuzzyHash, candidates int)
+
+	// ShortestDistance picks one of the siblings at the same distance
+	// randomly. Default is the sibling with the smallest hash, I compare
+	// the words of the hashes, the first word is the most significant
+	// TiesSeed seeds the random generator
+	RandomizeTies bool
+	TiesSeed      int64
+
+	// TieBreaker returns true if ShortestDistance shall prefer the hash
+	// 'a' over the hash 'b' at the same distance. For example, prefer
+	// the lowest ID. TieBreaker overrides RandomizeTies. Default (nil) is
+	// the smallest hash. Many threads can call TieBreaker
+	// simultaneously
+	TieBreaker func(a, b FuzzyHash) bool
+
+	// The multi-index skips buckets with more than MaxBucketScan hashes
+	// Zero (default) means no limit. Huge buckets are the blocks shared by
+	// many hashes, such a block hardly tells the hashes apart. The search
+	// misses a sibling if all blocks the sibling shares with the query
+	// are in the skipped buckets. Use it to trade recall for latency
+	MaxBucketScan int
+
+	// The multi-index writes a line for every candidate to DebugOutput
+	// Nil (default) disables the debug output. I format the lines in a
+	// reusable buffer and do not allocate per candidate. Many threads
+	// can write to DebugOutput simultaneously
+	DebugOutput io.Writer
+
+	// Normalizer converts the hash strings before parsing in the loaders
+	// NewFromHex() and AddFromScanner(). For example, strip the "0x"
+	// prefix. Nil (default) keeps the strings as is
+	Normalizer func(string) string
+
+	// The multi-index probes the blocks with higher entropy first if
+	// ReorderBlocks is set. A high entropy block splits the hashes into
+	// small buckets, the search finds the closest sibling sooner. This helps
+	// MaxCandidates and ShortestDistanceStream(), the full search checks
+	// the same candidates in another order. I compute the order in
+	// H.ReorderBlocks() and RebuildIndex()
+	ReorderBlocks bool
+
+	// The queries always update the counters atomically, many threads
+	// run the queries. Add and remove increment the counters without
+	// atomics unless AtomicStats is set. Set AtomicStats to call Stats()
+	// from a monitoring goroutine while adding hashes. An atomic
+	// increment costs a few nanoseconds, Add() usually increments one
+	// counter and takes ~14us with the multi-index, the cost is well
+	// below 1%
+	AtomicStats bool
 }
 
 // H structure keeps hash tables for fast hamming distance calculation
-// I am running lock free. Only one thread handles lookup/add/remove
-// operations
+// I am running lock free. Only one thread handles add/remove
+// operations. Many threads can call lookup APIs simultaneously
 // See "Fast and compact Hamming distance index" (Simon Gog, Rossano Venturini)
 type H struct {
 	config Config
@@ -202,9 +616,13 @@ type H struct {
 	hashes []FuzzyHash
 
 	// multi index tables storing index tables by bit substring position in the
-	// hash; I support at most 256 blocks
+	// hash; one table per block
 	multiIndexTables []indexTable
 
+	// The order of the blocks in the search, see Config.ReorderBlocks
+	// Nil means the natural order
+	blockOrder []int
+
 	// A map of all entries in the array 'hashes'. I need the map for quick removal of hashes
 	// Number of hashes I can keep wont excees 2^32-1. For 32 bytes hashes 2^32 is 140GB
 	// For larger sets I can use address of the hash (uintptr)
@@ -213,30 +631,250 @@ type H struct {
 	// an entry in the map. I can do add/remove in O(1) time instead of O(N*ln(N))
 	hashesLookup map[string]uint32
 
+	// Number of times a hash was added again. I keep only the hashes
+	// added more than once, the keys alias the stored hashes
+	duplicates map[string]uint32
+
+	// The maps keep copies of the keys, see RehashSafe()
+	safeKeys bool
+	// add/remove use the buffer for the safe keys
+	keyBuffer []byte
+
+	blockLayout
+
+	// depends on config.UseMultiindex
+	distance func(h *H, hash FuzzyHash) Sibling
+
+	// Buffers for the lookups running in parallel
+	scratchPool *sync.Pool
+
+	// Debug counters, see Stats()
+	statistics *Statistics
+
+	// Config.RandomizeTies, many threads share the generator
+	random      *rand.Rand
+	randomMutex sync.Mutex
+
+	// Write ahead log, see AttachWAL()
+	wal       io.Writer
+	walErr    error
+	walRecord []byte
+}
+
+// queryScratch keeps buffers a lookup needs. I do not want to allocate
+// (and zero) an array of all hashes for every query
+type queryScratch struct {
+	// checkedCandidates[i] == generation if the query checked hash i
+	checkedCandidates []uint32
+	generation        uint32
+
+	// Contains() uses the buffer for the safe keys
+	keyBuffer []byte
+
+	// The debug output uses the buffer for the lines
+	debugBuffer []byte
+}
+
+func newQueryScratch() interface{} {
+	return &queryScratch{}
+}
+
+// getScratch returns a scratch ready for a new query. The caller returns
+// the scratch to the pool
+func (h *H) getScratch() *queryScratch {
+	scratch := h.scratchPool.Get().(*queryScratch)
+	h.resetScratch(scratch)
+	return scratch
+}
+
+// resetScratch prepares the scratch for a new query
+func (h *H) resetScratch(scratch *queryScratch) {
+	if len(scratch.checkedCandidates) < len(h.hashes) {
+		scratch.checkedCandidates = make([]uint32, len(h.hashes))
+		scratch.generation = 0
+	}
+	scratch.generation++
+	if scratch.generation == 0 { // wrap around, start from scratch
+		for i := range scratch.checkedCandidates {
+			scratch.checkedCandidates[i] = 0
+		}
+		scratch.generation = 1
+	}
+}
+
+// ReadCtx keeps the buffers of a query. ShortestDistanceCtx() reuses the
+// buffers and does not allocate. ReadCtx is not thread safe, every
+// goroutine shall use own ReadCtx
+// ReadCtx is good for one H, call NewReadCtx() for every H
+type ReadCtx struct {
+	scratch queryScratch
+	hash    FuzzyHash // a copy of the query with the zero padding
+}
+
+// NewReadCtx returns a new query context
+func (h *H) NewReadCtx() *ReadCtx {
+	return &ReadCtx{
+		hash: make(FuzzyHash, 0, h.config.words()),
+	}
+}
+
+// maskPadding returns the hash with zero padding bits. I copy the hash to the
+// context buffer if the padding is not zero
+func (ctx *ReadCtx) maskPadding(hash FuzzyHash, bits int) FuzzyHash {
+	if !hash.hasPadding(bits) {
+		return hash
+	}
+	ctx.hash = append(ctx.hash[:0], hash...)
+	ctx.hash[0] &^= ctx.hash.paddingMask(bits)
+	return ctx.hash
+}
+
+// words returns number of 64 bits words in a hash
+func (config Config) words() int {
+	return (config.HashSize + 63) / 64
+}
+
+// blockLayout describes the bit substrings of the hash I keep in
+// the multi-index
+// Block 'b' starts at bit b*blockStep. Without overlap blockStep is
+// equal to blockSize and the blocks do not overlap
+type blockLayout struct {
 	blocks        int // number of blocks in the hash
 	blockSize     int // size of the block
+	blockStep     int // distance between the first bits of two blocks
 	lastBlockSize int // size of the last block, often != blockSize
+}
 
-	// depends on config.UseMultiindex
-	distance func(h *H, hash FuzzyHash) Sibling
+// maxBlocks is the maximum number of blocks in the multi-index
+const maxBlocks = 255
+
+func (config Config) blockLayout() (blockLayout, error) {
+	blocks := config.MaxDistance + 1 // If maxDsitance is 35 bits I need 36 blocks
+	if blocks > maxBlocks {
+		return blockLayout{}, fmt.Errorf("I do not support more than %d blocks, got %d", maxBlocks, blocks)
+	}
+	blockSize := config.HashSize / blocks // and block size 7.11(1) bits
+	if blockSize == 0 {
+		return blockLayout{}, fmt.Errorf("hash size %d is too small for %d blocks", config.HashSize, blocks)
+	}
+	if (config.BlockOverlap < 0) || (config.BlockOverlap >= blockSize) {
+		return blockLayout{}, fmt.Errorf("block overlap %d is not in [0, %d)", config.BlockOverlap, blockSize)
+	}
+	blockStep := blockSize - config.BlockOverlap
+
+	// The blocks cover the whole hash. The last block is larger
+	// 35 seven bits blocks and one 11 bits block
+	if blockStep != blockSize {
+		blocks = (config.HashSize-blockSize)/blockStep + 1
+	}
+	if blocks > maxBlocks {
+		return blockLayout{}, fmt.Errorf("I do not support more than %d blocks, got %d overlapping blocks", maxBlocks, blocks)
+	}
+	lastBlockSize := config.HashSize - ((blocks - 1) * blockStep) // 11 bits
+
+	return blockLayout{
+		blocks:        blocks,
+		blockSize:     blockSize,
+		blockStep:     blockStep,
+		lastBlockSize: lastBlockSize,
+	}, nil
+}
+
+// ProbeCount returns the number of index tables a query probes in the
+// multi-index. I return 0 if the configuration is not valid
+func (config Config) ProbeCount() int {
+	layout, err := config.blockLayout()
+	if err != nil {
+		return 0
+	}
+	return layout.blocks
+}
+
+// WouldFind reports if the configuration guarantees that a query 'a' checks
+// the hash 'b' and a query 'b' checks the hash 'a'. Without the multi-index
+// a query checks all hashes. The multi-index checks a hash if at least one
+// block of the hash matches the block of the query. Pigeonhole: all pairs
+// within MaxDistance match in at least one block. Pairs with the differences
+// clustered in a few blocks can match beyond MaxDistance
+// I return false if the configuration is not valid or the hashes are not
+// of the configured size
+func (config Config) WouldFind(a, b FuzzyHash) bool {
+	layout, err := config.blockLayout()
+	if err != nil {
+		return false
+	}
+	if (len(a) != config.words()) || (len(b) != config.words()) {
+		return false
+	}
+	if !config.UseMultiindex {
+		return true
+	}
+	for block := 0; block < layout.blocks; block++ {
+		if layout.blockValue(a, block) == layout.blockValue(b, block) {
+			return true
+		}
+	}
+	return false
+}
+
+// AvgBucketOccupancy returns the expected number of hashes in a bucket a
+// query probes if the DB keeps numHashes uniformly distributed hashes
+// ProbeCount()*AvgBucketOccupancy() is roughly the number of candidates
+// a query checks. I return 0 if the configuration is not valid
+func (config Config) AvgBucketOccupancy(numHashes int) float64 {
+	layout, err := config.blockLayout()
+	if err != nil {
+		return 0
+	}
+	occupancy := 0.0
+	for b := 0; b < layout.blocks; b++ {
+		blockSize := layout.blockSize
+		if b == layout.blocks-1 {
+			blockSize = layout.lastBlockSize
+		}
+		if blockSize > 16 { // the block values are 16 bits
+			blockSize = 16
+		}
+		occupancy += float64(numHashes) / float64(uint64(1)<<uint(blockSize))
+	}
+	return occupancy / float64(layout.blocks)
 }
 
 // New creates an instance of hammer distance calculator
 // Set useMultiindex to 'false' for best performance
 func New(config Config) (*H, error) {
-	if config.HashSize%64 != 0 {
-		return &H{}, fmt.Errorf("hash size modulus 64 is not zero %d", config.HashSize)
+	h := &H{}
+	if err := h.init(config); err != nil {
+		return &H{}, err
 	}
+	return h, nil
+}
 
-	blocks := config.MaxDistance + 1 // If maxDsitance is 35 bits I need 36 blocks
-	if blocks > 255 {
-		return &H{}, fmt.Errorf("I do not support more than 255 blocks, got %d", blocks)
+// init validates the configuration and resets the DB to an empty state
+// I do not modify the DB if the configuration is not valid
+func (h *H) init(config Config) error {
+	if config.HashSize <= 0 {
+		return fmt.Errorf("hash size is not positive %d", config.HashSize)
 	}
-	blockSize := config.HashSize / blocks // and block size 7.11(1) bits
-	lastBlockSize := blockSize            // 35 seven bits blocks and one 11 bits block
 
-	if blocks*blockSize < config.HashSize { // 36*7=252 < 256
-		lastBlockSize = config.HashSize - ((blocks - 1) * blockSize) // 11 bits
+	layout, err := config.blockLayout()
+	if err != nil {
+		return err
+	}
+	if config.MaxCandidates < 0 {
+		return fmt.Errorf("max candidates is negative %d", config.MaxCandidates)
+	}
+	if config.ExpectedCount < 0 {
+		return fmt.Errorf("expected count is negative %d", config.ExpectedCount)
+	}
+	if config.MaxBucketScan < 0 {
+		return fmt.Errorf("max bucket scan is negative %d", config.MaxBucketScan)
+	}
+	if config.SlowQueryThreshold < 0 {
+		return fmt.Errorf("slow query threshold is negative %d", config.SlowQueryThreshold)
+	}
+	if config.PopcountMode == PopcountTable {
+		popcountTableOnce.Do(initPopcountTable)
 	}
 	// lastBlockCombinations := combin.Combinations(lastBlockSize, blockSize)
 
@@ -246,18 +884,24 @@ func New(config Config) (*H, error) {
 		distance = (*H).shortestDistanceMultiindex
 	}
 
-	h := H{
-		config:        config,
-		blockSize:     blockSize,
-		lastBlockSize: lastBlockSize,
-		blocks:        blocks,
+	*h = H{
+		config:      config,
+		blockLayout: layout,
 
-		multiIndexTables: make([]indexTable, 256),
-		hashesLookup:     make(map[string]uint32),
+		multiIndexTables: make([]indexTable, layout.blocks),
+		hashes:           make([]FuzzyHash, 0, config.ExpectedCount),
+		hashesLookup:     make(map[string]uint32, config.ExpectedCount),
+		duplicates:       make(map[string]uint32),
 		distance:         distance,
+		scratchPool:      &sync.Pool{New: newQueryScratch},
+		statistics:       &Statistics{},
+	}
+	if config.RandomizeTies {
+		h.random = rand.New(rand.NewSource(config.TiesSeed))
 	}
+	lastStatistics.Store(h.statistics)
 
-	return &h, nil
+	return nil
 }
 
 /*
@@ -305,21 +949,67 @@ var asciiCodes = []int{
 }
 
 // BytesToFuzzyHash converts []byte to FuzzyHash
+// The first byte is the most significant, the same order as in the hex
+// strings HashStringToFuzzyHash consumes
 func BytesToFuzzyHash(data []byte) (FuzzyHash, error) {
 	fuzzyHash := []uint64{}
 	if len(data) % 8 != 0 {
 		return fuzzyHash, fmt.Errorf("Bad length %d in %v", len(data), data)
 	}
 	fuzzyHash = make([]uint64, len(data)/8)
-	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, fuzzyHash)
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, fuzzyHash)
 	return fuzzyHash, err
 }
 
+// Bytes converts the hash to []byte, the inverse of BytesToFuzzyHash
+// The first byte is the most significant
+func (fh FuzzyHash) Bytes() []byte {
+	data := make([]byte, 8*len(fh))
+	for i, v := range fh {
+		binary.BigEndian.PutUint64(data[8*i:], v)
+	}
+	return data
+}
+
+// FuzzyHashFromBigInt converts a non negative integer to a FuzzyHash of
+// 'bits' bits. I pad the hash with leading zeros. The layout is the same as
+// in HashStringToFuzzyHash: the first word is the most significant
+func FuzzyHashFromBigInt(n *big.Int, bits int) (FuzzyHash, error) {
+	if bits <= 0 {
+		return nil, fmt.Errorf("hash size is not positive %d", bits)
+	}
+	if n.Sign() < 0 {
+		return nil, fmt.Errorf("negative value %s", n.String())
+	}
+	if n.BitLen() > bits {
+		return nil, fmt.Errorf("value is %d bits, expected at most %d bits", n.BitLen(), bits)
+	}
+	data := n.Bytes()
+	padded := make([]byte, 8*((bits+63)/64))
+	copy(padded[len(padded)-len(data):], data)
+	return BytesToFuzzyHash(padded)
+}
+
+// BigInt converts the hash to an integer, the inverse of FuzzyHashFromBigInt
+func (fh FuzzyHash) BigInt() *big.Int {
+	return new(big.Int).SetBytes(fh.Bytes())
+}
+
+// FromUint64s copies the words to a new FuzzyHash
+// The first word is the most significant. Returns an error if the words
+// do not make exactly 'expectedBits' bits
+func FromUint64s(words []uint64, expectedBits int) (FuzzyHash, error) {
+	if len(words)*64 != expectedBits {
+		return FuzzyHash{}, fmt.Errorf("Bad length %d words, expected %d bits", len(words), expectedBits)
+	}
+	return FuzzyHash(words).Dup(), nil
+}
+
 // HashStringToFuzzyHash converts
 // "112233445566778899AA112233445566" to [FuzzyHash]{0x1122334455667788, 0x99AA112233445566}
 func HashStringToFuzzyHash(s string) (FuzzyHash, error) {
 	fuzzyHash := []uint64{}
-	if len(s)%2 != 0 {
+	if len(s)%16 != 0 { // 16 characters in every 64 bits word
 		return fuzzyHash, fmt.Errorf("Bad length %d in '%s", len(s), s)
 	}
 	var val uint64
@@ -346,6 +1036,42 @@ func HashStringToFuzzyHash(s string) (FuzzyHash, error) {
 	return fuzzyHash, nil
 }
 
+// HashStringToFuzzyHashTrimBraces parses a hash string wrapped in braces
+// "{...}" or in the hex codes of the braces "7B...7D". A MySQL dump of a
+// binary column looks like this
+// I strip the hex codes only if the length of the string without the codes
+// is a multiple of 16 characters. A hash which starts with "7B" and ends
+// with "7D" is parsed as is
+func HashStringToFuzzyHashTrimBraces(s string) (FuzzyHash, error) {
+	if (len(s) >= 2) && (s[0] == '{') && (s[len(s)-1] == '}') {
+		s = s[1 : len(s)-1]
+	} else if (len(s)%16 == 4) && strings.EqualFold(s[:2], "7B") && strings.EqualFold(s[len(s)-2:], "7D") {
+		s = s[2 : len(s)-2]
+	}
+	return HashStringToFuzzyHash(s)
+}
+
+// Distance returns the hamming distance between two hashes of the same size
+// I do not allocate. The multi-index calls distanceUint64s directly, the
+// hashes in the DB are of the same size
+func Distance(a, b FuzzyHash) (int, error) {
+	if !a.Comparable(b) {
+		return 0, fmt.Errorf("hash is %d bits, expected %d bits", b.Bits(), a.Bits())
+	}
+	return distanceUint64s(a, b), nil
+}
+
+// RequiredDistance returns the smallest MaxDistance which finds the
+// pair, the hamming distance between the hashes. I return -1 if the hashes
+// are of different size
+func RequiredDistance(a, b FuzzyHash) int {
+	d, err := Distance(a, b)
+	if err != nil {
+		return -1
+	}
+	return d
+}
+
 // Call to bits.OnesCount64() is faster than anything else by at least 30% in my tests
 // See https://stackoverflow.com/questions/19105791/is-there-a-big-bitcount/32695740#32695740
 // http://github.com/steakknife/hamming
@@ -364,58 +1090,115 @@ func distanceUint64s(b0, b1 []uint64) int {
 	return int(d)
 }
 
+// PopcountMode selects the population count implementation for
+// the hamming distance
+type PopcountMode int
+
+const (
+	// PopcountHardware uses bits.OnesCount64(), POPCNT on amd64
+	PopcountHardware PopcountMode = iota
+	// PopcountTable uses a 64K entries lookup table. Use on the CPUs
+	// without the POPCNT instruction
+	PopcountTable
+)
+
+var popcountTable [1 << 16]uint8
+var popcountTableOnce sync.Once
+
+func initPopcountTable() {
+	for i := range popcountTable {
+		popcountTable[i] = uint8(bits.OnesCount16(uint16(i)))
+	}
+}
+
+// distanceUint64sTable is distanceUint64s() which looks up the number of
+// bits in a table, 16 bits at time
+func distanceUint64sTable(b0, b1 []uint64) int {
+	d := 0
+	for i := 0; i < len(b0); i++ {
+		x := b0[i] ^ b1[i]
+		d += int(popcountTable[x&0xFFFF]) + int(popcountTable[(x>>16)&0xFFFF]) +
+			int(popcountTable[(x>>32)&0xFFFF]) + int(popcountTable[x>>48])
+	}
+	return d
+}
+
+// hammingDistance returns distance between two hashes using the configured
+// population count
+func (h *H) hammingDistance(b0, b1 []uint64) int {
+	return h.config.PopcountMode.distance(b0, b1)
+}
+
+func (popcountMode PopcountMode) distance(b0, b1 []uint64) int {
+	if popcountMode == PopcountTable {
+		return distanceUint64sTable(b0, b1)
+	}
+	return distanceUint64s(b0, b1)
+}
+
 // Recipe from https://play.golang.org/p/k53JzyvnE0
-func addMultiindex(multiIndexTables []indexTable, blockIndex uint8, blockValue uint16, hashIndex uint32, preallocate int) {
-	if multiIndexTables[blockIndex] == nil {
-		multiIndexTables[blockIndex] = make(map[uint16]([]uint32))
+func (h *H) addMultiindex(blockIndex int, blockValue uint16, hashIndex uint32, preallocate int) {
+	if blockIndex >= len(h.multiIndexTables) {
+		h.count(&h.statistics.AddIndexBadHash)
+		return
+	}
+	if h.multiIndexTables[blockIndex] == nil {
+		h.multiIndexTables[blockIndex] = make(map[uint16]([]uint32))
 	}
-	indexTable := multiIndexTables[blockIndex]
+	indexTable := h.multiIndexTables[blockIndex]
 	if _, ok := indexTable[blockValue]; !ok {
-		indexTable[blockValue] = make([]uint32, preallocate)
+		indexTable[blockValue] = make([]uint32, 0, preallocate)
 	}
 	hashes := indexTable[blockValue]
 	insertIndex := sort.Search(len(hashes), func(i int) bool { return hashes[i] >= hashIndex })
 	if (len(hashes) > insertIndex) && (hashes[insertIndex] == hashIndex) {
-		statistics.AddIndexExists1++
+		h.count(&h.statistics.AddIndexExists1)
 		return
 	}
 	hashes = append(hashes, 0)
 	copy(hashes[insertIndex+1:], hashes[insertIndex:])
 	hashes[insertIndex] = hashIndex
 	indexTable[blockValue] = hashes
-	multiIndexTables[blockIndex] = indexTable
+	h.multiIndexTables[blockIndex] = indexTable
 	// fmt.Printf("blockIndex %d, blockValue %d, hashIndex %d\n", blockIndex, blockValue, hashIndex)
 	// fmt.Printf("hashes[insertIndex]=%v,indexTable[blockValue]=%v,multiIndexTables[blockIndex]=%v\n",
 	// 	hashes[insertIndex], indexTable[blockValue], multiIndexTables[blockIndex])
 }
 
-func removeMultiindex(multiIndexTables []indexTable, blockIndex uint8, blockValue uint16, hashIndex uint32, preallocate int) {
-	if multiIndexTables[blockIndex] == nil {
-		statistics.RemoveIndexNotFound1++
+func (h *H) removeMultiindex(blockIndex int, blockValue uint16, hashIndex uint32, preallocate int) {
+	if (blockIndex >= len(h.multiIndexTables)) || (h.multiIndexTables[blockIndex] == nil) {
+		h.count(&h.statistics.RemoveIndexNotFound1)
 		return
 	}
-	indexTable := multiIndexTables[blockIndex]
+	indexTable := h.multiIndexTables[blockIndex]
 	if _, ok := indexTable[blockValue]; !ok {
-		statistics.RemoveIndexNotFound2++
+		h.count(&h.statistics.RemoveIndexNotFound2)
 		return
 	}
 	hashes := indexTable[blockValue]
 	removeIndex := sort.Search(len(hashes), func(i int) bool { return hashes[i] >= hashIndex })
-	if (len(hashes) <= removeIndex) || (hashes[removeIndex] == hashIndex) {
-		statistics.RemoveIndexNotFound3++
+	if (len(hashes) <= removeIndex) || (hashes[removeIndex] != hashIndex) {
+		h.count(&h.statistics.RemoveIndexNotFound3)
 		return
 	}
 	copy(hashes[removeIndex:], hashes[removeIndex+1:])
 	hashes = hashes[:len(hashes)-1]
 	indexTable[blockValue] = hashes
-	multiIndexTables[blockIndex] = indexTable
+	h.multiIndexTables[blockIndex] = indexTable
 }
 
 func (h *H) Add(hash FuzzyHash) bool {
-	statistics.AddIndex++
+	h.count(&h.statistics.AddIndex)
+	if !h.validHash(hash) {
+		h.count(&h.statistics.AddIndexBadHash)
+		return false
+	}
+	hash = hash.maskPadding(h.config.HashSize)
 	key := hash.toKey()
-	if _, ok := h.hashesLookup[key]; ok {
-		statistics.AddIndexExists++
+	if hashIndex, ok := h.hashesLookup[key]; ok {
+		h.count(&h.statistics.AddIndexExists)
+		h.duplicates[h.mapKey(h.hashes[hashIndex])]++
+		h.appendWAL(walOpAdd, hash)
 		return false
 	}
 	// add the new hash to the end of the list
@@ -423,62 +1206,178 @@ func (h *H) Add(hash FuzzyHash) bool {
 	h.hashes = append(h.hashes, hash)
 
 	// I maintain a map for quick removing a hash
-	h.hashesLookup[key] = uint32(hashIndex)
+	h.hashesLookup[h.mapKey(hash)] = uint32(hashIndex)
+	h.appendWAL(walOpAdd, hash)
 
 	if !h.config.UseMultiindex {
 		return true
 	}
 
-	// Add hashIndex to the sorted arrays in multiIndexTables
-	hash = hash.Dup()
-	blockMask := (uint64(1) << uint64(h.blockSize)) - 1
-	preallocationSize := len(h.hashesLookup) / (1 << uint(h.blockSize)) // Roughly half of what I need
-	for b := uint8(0); b < uint8(h.blocks); b++ {
-		blockValue := hash.and(blockMask)
-		hash.rsh(uint64(h.blockSize))
-		addMultiindex(h.multiIndexTables, b, uint16(blockValue), hashIndex, preallocationSize)
-	}
+	h.addHashMultiindex(hash, hashIndex)
 	// fmt.Printf("h.hashes=%v\n", h.hashes)
 
-	// The last bock can be larger than h.blockSize
-	// I want to add all Combinations(h.lastBlockSize, h.blockSize)
-	// If lastBlockSize is 11 and blockSize is 7
-	// C(11,7)= {{0,1,2,3,4,5,6}, {1,2,3,4,5,6,7}, ... } - 330 combinations
-	//blockValues := generateBitCombinations(hash[len(hash)-1], h.lastBlockCombinations)
-	//for _, blockValue := range blockValues {
-	//        removeMultiindex(h.multiIndexTables, uint16(blockValue), hashIndex, preallocationSize)
-	//}
+	// The last bock can be larger than h.blockSize. I do not index all
+	// Combinations(h.lastBlockSize, h.blockSize), C(11,7) is 330 entries
+	// per hash. There are MaxDistance+1 disjoint blocks, a sibling within
+	// MaxDistance shares at least one block with the query. The large last
+	// block counts like any other block
 
 	return true
 }
 
-func (h *H) remove(hash FuzzyHash) bool {
-	statistics.RemoveIndex++
-	key := hash.toKey()
-	if _, ok := h.hashesLookup[key]; !ok {
-		statistics.RemoveIndexNotFound++
-		return false
-	}
-
-	// I maintain a map for quick removing a hash
-	hashIndex := uint32(h.hashesLookup[key])
-	delete(h.hashesLookup, key)
-	copy(h.hashes[hashIndex:], h.hashes[hashIndex+1:])
+// validHash returns true if the hash is of the configured size
+// The block walk reads the hash up to the configured size
+func (h *H) validHash(hash FuzzyHash) bool {
+	return (len(hash) > 0) && (len(hash) == h.config.words())
+}
 
-	if !h.config.UseMultiindex {
-		return true
+// preallocationSize returns the initial capacity of the lists of hashes
+// in the multi-index tables
+func (h *H) preallocationSize() int {
+	count := len(h.hashesLookup)
+	if count < h.config.ExpectedCount {
+		count = h.config.ExpectedCount
 	}
-
-	// Remove hashIndex from the sorted arrays in multiIndexTables
-	blockMask := (uint64(1) << uint64(h.blockSize)) - 1
-	preallocationSize := len(h.hashesLookup) / (1 << uint(h.blockSize)) // Roughly half of what I need
-	for b := uint8(0); b < uint8(h.blocks); b++ {
-		blockValue := hash.and(blockMask)
-		hash.rsh(uint64(h.blockSize))
-		removeMultiindex(h.multiIndexTables, b, uint16(blockValue), hashIndex, preallocationSize)
+	// The count is below 2^32, large blocks get no preallocation. A shift
+	// by 64 bits or more is zero and the division panics
+	if h.blockSize >= 32 {
+		return 0
 	}
+	return count / (1 << uint(h.blockSize)) // Roughly half of what I need
+}
 
-	return true
+// Add hashIndex to the sorted arrays in multiIndexTables
+func (h *H) addHashMultiindex(hash FuzzyHash, hashIndex uint32) {
+	var buffer [256]uint16
+	blockValues := h.blockValues(hash, buffer[:0])
+	preallocationSize := h.preallocationSize()
+	for b, blockValue := range blockValues {
+		h.addMultiindex(b, blockValue, hashIndex, preallocationSize)
+	}
+}
+
+// blockValues appends values of all blocks in the hash to the slice
+// Block 0 is the least significant bits of the hash. The last block
+// keeps all remaining bits, often more than h.blockSize
+func (layout *blockLayout) blockValues(hash FuzzyHash, blockValues []uint16) []uint16 {
+	for b := 0; b < layout.blocks; b++ {
+		blockValues = append(blockValues, layout.blockValue(hash, b))
+	}
+	return blockValues
+}
+
+// blockValue returns the value of the block b in the hash
+func (layout *blockLayout) blockValue(hash FuzzyHash, b int) uint16 {
+	blockSize := layout.blockSize
+	if b == layout.blocks-1 {
+		blockSize = layout.lastBlockSize
+	}
+	return uint16(hash.bitsAt(b*layout.blockStep, blockSize))
+}
+
+// ExplainMiss reports why the multi-index does (or does not) find the
+// target for the query. The report lists the blocks where the query and the
+// target differ and the matching blocks which miss the target in the index
+// The multi-index finds the target if at least one block matches
+func (h *H) ExplainMiss(query, target FuzzyHash) string {
+	var buffer bytes.Buffer
+	if !h.validHash(query) || !h.validHash(target) {
+		return fmt.Sprintf("bad hash size %d and %d bits, expected %d bits", query.Bits(), target.Bits(), h.config.HashSize)
+	}
+	query = query.maskPadding(h.config.HashSize)
+	target = target.maskPadding(h.config.HashSize)
+	buffer.WriteString(fmt.Sprintf("distance %d, max distance %d, %d blocks\n",
+		h.hammingDistance(query, target), h.config.MaxDistance, h.blocks))
+	hashIndex, stored := h.hashesLookup[target.toKey()]
+	if !stored {
+		buffer.WriteString("target is not in the DB\n")
+	}
+
+	matches, missing := 0, 0
+	for b := 0; b < h.blocks; b++ {
+		blockSize := h.blockSize
+		if b == h.blocks-1 {
+			blockSize = h.lastBlockSize
+		}
+		offset := b * h.blockStep
+		queryValue := query.bitsAt(offset, blockSize)
+		targetValue := target.bitsAt(offset, blockSize)
+		if queryValue != targetValue {
+			buffer.WriteString(fmt.Sprintf("block %d bits %d-%d: %d bits differ\n",
+				b, offset, offset+blockSize-1, bits.OnesCount64(queryValue^targetValue)))
+			continue
+		}
+		matches++
+		if !stored || !h.config.UseMultiindex {
+			continue
+		}
+		candidates := h.multiIndexTables[b][uint16(targetValue)]
+		i := sort.Search(len(candidates), func(i int) bool { return candidates[i] >= hashIndex })
+		if (i == len(candidates)) || (candidates[i] != hashIndex) {
+			missing++
+			buffer.WriteString(fmt.Sprintf("block %d bits %d-%d: match, the index misses the target\n",
+				b, offset, offset+blockSize-1))
+		}
+	}
+
+	buffer.WriteString(fmt.Sprintf("%d of %d blocks match: ", matches, h.blocks))
+	switch {
+	case !stored:
+		buffer.WriteString("nothing to find")
+	case !h.config.UseMultiindex:
+		buffer.WriteString("brute force finds the target")
+	case matches == 0:
+		buffer.WriteString("all blocks differ, the multi-index does not find the target")
+	case missing == matches:
+		buffer.WriteString("the index is broken, the multi-index does not find the target")
+	default:
+		buffer.WriteString("the multi-index finds the target")
+	}
+	return buffer.String()
+}
+
+// Decompose returns values of all blocks in the hash in the order the
+// multi-index uses. The first value is the least significant bits of the
+// hash, the last value is the last (often larger) block
+func (h *H) Decompose(hash FuzzyHash) []uint16 {
+	return h.blockValues(hash, make([]uint16, 0, h.blocks))
+}
+
+func (h *H) remove(hash FuzzyHash) bool {
+	h.count(&h.statistics.RemoveIndex)
+	if !h.validHash(hash) {
+		h.count(&h.statistics.RemoveIndexNotFound)
+		return false
+	}
+	hash = hash.maskPadding(h.config.HashSize)
+	key := hash.toKey()
+	if _, ok := h.hashesLookup[key]; !ok {
+		h.count(&h.statistics.RemoveIndexNotFound)
+		return false
+	}
+
+	// I maintain a map for quick removing a hash
+	hashIndex := uint32(h.hashesLookup[key])
+	delete(h.hashesLookup, key)
+	delete(h.duplicates, key)
+	// I keep a tombstone, the indexes of other hashes do not change
+	// See CompactHashes()
+	h.hashes[hashIndex] = nil
+	h.appendWAL(walOpRemove, hash)
+
+	if !h.config.UseMultiindex {
+		return true
+	}
+
+	// Remove hashIndex from the sorted arrays in multiIndexTables
+	var buffer [256]uint16
+	blockValues := h.blockValues(hash, buffer[:0])
+	preallocationSize := h.preallocationSize()
+	for b, blockValue := range blockValues {
+		h.removeMultiindex(b, blockValue, hashIndex, preallocationSize)
+	}
+
+	return true
 }
 
 func generateBitCombinations(value uint64, combinations [][]int) (r []uint64) {
@@ -504,11 +1403,103 @@ func (h *H) AddBulk(hashes []FuzzyHash) bool {
 	return ok
 }
 
+// ReorderBlocks sorts the blocks of the multi-index by entropy if
+// Config.ReorderBlocks is set. The entropy of a block is the sum of the
+// entropies of the bits. I read all hashes, add and remove do not update
+// the order. Call ReorderBlocks() after loading the DB or after large
+// changes of the data set. RebuildIndex() reorders the blocks
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) ReorderBlocks() {
+	if !h.config.ReorderBlocks || !h.config.UseMultiindex {
+		return
+	}
+	bitEntropy := h.BitEntropy()
+	blockEntropy := make([]float64, h.blocks)
+	blockOrder := make([]int, h.blocks)
+	for b := range blockEntropy {
+		blockSize := h.blockSize
+		if b == h.blocks-1 {
+			blockSize = h.lastBlockSize
+		}
+		for bit := b * h.blockStep; bit < b*h.blockStep+blockSize; bit++ {
+			blockEntropy[b] += bitEntropy[bit]
+		}
+		blockOrder[b] = b
+	}
+	sort.SliceStable(blockOrder, func(i, j int) bool {
+		return blockEntropy[blockOrder[i]] > blockEntropy[blockOrder[j]]
+	})
+	h.blockOrder = blockOrder
+}
+
+// forEachHash calls f() for every hash in the DB in the order of insertion
+func (h *H) forEachHash(f func(hash FuzzyHash)) {
+	for hashIndex, hash := range h.hashes {
+		if hash == nil { // removed
+			continue
+		}
+		if index, ok := h.hashesLookup[hash.toKey()]; ok && (index == uint32(hashIndex)) {
+			f(hash)
+		}
+	}
+}
+
 // Count returns number of hashes in the dictionary
 func (h *H) Count() int {
+	return len(h.hashesLookup)
+}
+
+// CompactHashes drops the tombstones of the removed hashes, renumbers the
+// hashes and rebuilds the lookup map and the multi-index tables
+// I return the number of hashes in the DB
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) CompactHashes() int {
+	hashes := h.hashes[:0]
+	for _, hash := range h.hashes {
+		if hash != nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	// Let GC collect the tail
+	for i := len(hashes); i < len(h.hashes); i++ {
+		h.hashes[i] = nil
+	}
+	h.hashes = hashes
+	// Add() and remove() keep the array consistent, RebuildIndex() does
+	// not fail
+	h.RebuildIndex()
 	return len(h.hashes)
 }
 
+// RemoveFunc removes all hashes for which pred() returns true and returns
+// the number of removed hashes. Removing hashes one by one shifts the sorted
+// arrays in the index tables many times, I rebuild the tables once
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) RemoveFunc(pred func(FuzzyHash) bool) int {
+	removed := 0
+	for hashIndex, hash := range h.hashes {
+		if (hash == nil) || !pred(hash) {
+			continue
+		}
+		h.count(&h.statistics.RemoveIndex)
+		key := hash.toKey()
+		delete(h.hashesLookup, key)
+		delete(h.duplicates, key)
+		h.hashes[hashIndex] = nil
+		h.appendWAL(walOpRemove, hash)
+		removed++
+	}
+	if (removed > 0) && h.config.UseMultiindex {
+		for b := 0; b < h.blocks; b++ {
+			h.RebuildBlock(b)
+		}
+	}
+	return removed
+}
+
 // RemoveBulk removes specified hashes from the DB
 // This API is not reentrant and should not be called simultaneously
 // with add/remove/dup/distance
@@ -520,23 +1511,310 @@ func (h *H) RemoveBulk(hashes []FuzzyHash) bool {
 	return ok
 }
 
-// RemoveAll clears the DB
+// RemoveAll clears the DB. The log, see AttachWAL(), gets one record
 // This API is not reentrant and should not be called simultaneously
 // with add/remove/dup/distance
 func (h *H) RemoveAll() {
-	h.multiIndexTables = make([]indexTable, 256)
+	h.appendWAL(walOpClear, nil)
+	h.hashes = nil
+	h.multiIndexTables = make([]indexTable, h.blocks)
 	h.hashesLookup = make(map[string]uint32)
+	h.duplicates = make(map[string]uint32)
+	h.blockOrder = nil
+}
+
+// RebuildIndex restores the lookup map and the multi-index tables from
+// the array of hashes. Call it after the hashes were loaded from an external
+// source or when the tables went out of sync with the hashes.
+// The array of hashes is the source of truth. If the array itself is broken
+// (duplicate entries, hashes of a wrong size) RebuildIndex returns an error
+// and does not modify the DB
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) RebuildIndex() error {
+	hashesLookup := make(map[string]uint32, len(h.hashes))
+	for hashIndex, hash := range h.hashes {
+		if hash == nil { // removed
+			continue
+		}
+		if !h.validHash(hash) {
+			return fmt.Errorf("hash %d is %d bits, expected %d bits", hashIndex, len(hash)*64, h.config.HashSize)
+		}
+		if hash.hasPadding(h.config.HashSize) {
+			return fmt.Errorf("hash %d has non zero padding bits %s", hashIndex, hash.ToString())
+		}
+		key := hash.toKey()
+		if otherIndex, ok := hashesLookup[key]; ok {
+			return fmt.Errorf("hash %s is stored twice at %d and %d", hash.ToString(), otherIndex, hashIndex)
+		}
+		hashesLookup[h.mapKey(hash)] = uint32(hashIndex)
+	}
+
+	h.hashesLookup = hashesLookup
+	for key := range h.duplicates {
+		if _, ok := hashesLookup[key]; !ok {
+			delete(h.duplicates, key)
+		}
+	}
+	h.multiIndexTables = make([]indexTable, h.blocks)
+	if !h.config.UseMultiindex {
+		return nil
+	}
+	for hashIndex, hash := range h.hashes {
+		if hash != nil {
+			h.addHashMultiindex(hash, uint32(hashIndex))
+		}
+	}
+	h.ReorderBlocks()
+	return nil
+}
+
+// RebuildBlock restores the multi-index table of a single block from the
+// array of hashes. This is a surgical repair for the case when only one
+// table went out of sync with the hashes. I do nothing if the block index
+// is out of range or the multi-index is disabled
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) RebuildBlock(blockIndex int) {
+	if !h.config.UseMultiindex || (blockIndex < 0) || (blockIndex >= h.blocks) {
+		return
+	}
+	table := make(indexTable)
+	// Hash indexes grow, the arrays in the table remain sorted
+	for hashIndex, hash := range h.hashes {
+		if hash == nil { // removed
+			continue
+		}
+		blockValue := h.blockValue(hash, blockIndex)
+		table[blockValue] = append(table[blockValue], uint32(hashIndex))
+	}
+	h.multiIndexTables[blockIndex] = table
+}
+
+// mapKey returns a key for insertion into the maps
+func (h *H) mapKey(hash FuzzyHash) string {
+	if h.safeKeys {
+		h.keyBuffer = appendKey(h.keyBuffer[:0], hash)
+		return string(h.keyBuffer)
+	}
+	return hash.toKey()
+}
+
+// RehashSafe rebuilds the maps with keys which do not alias the hashes
+// The lookups keep using the fast unsafe keys, the maps do not depend on
+// the memory of the hashes. I copy the keys of all hashes added after
+// the call as well
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) RehashSafe() {
+	h.safeKeys = true
+	hashesLookup := make(map[string]uint32, len(h.hashesLookup))
+	for key, hashIndex := range h.hashesLookup {
+		h.keyBuffer = append(h.keyBuffer[:0], key...)
+		hashesLookup[string(h.keyBuffer)] = hashIndex
+	}
+	h.hashesLookup = hashesLookup
+	duplicates := make(map[string]uint32, len(h.duplicates))
+	for key, count := range h.duplicates {
+		h.keyBuffer = append(h.keyBuffer[:0], key...)
+		duplicates[string(h.keyBuffer)] = count
+	}
+	h.duplicates = duplicates
+}
+
+// Verify checks that the lookup map and the multi-index tables match
+// the array of hashes. I return the first inconsistency I find
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) Verify() error {
+	count := 0
+	for _, hash := range h.hashes {
+		if hash != nil {
+			count++
+		}
+	}
+	if len(h.hashesLookup) != count {
+		return fmt.Errorf("%d hashes, %d entries in the lookup map", count, len(h.hashesLookup))
+	}
+	for hashIndex, hash := range h.hashes {
+		if hash == nil { // removed
+			continue
+		}
+		if !h.validHash(hash) {
+			return fmt.Errorf("hash %d is %d bits, expected %d bits", hashIndex, len(hash)*64, h.config.HashSize)
+		}
+		if hash.hasPadding(h.config.HashSize) {
+			return fmt.Errorf("hash %d has non zero padding bits %s", hashIndex, hash.ToString())
+		}
+		if index, ok := h.hashesLookup[hash.toKey()]; !ok || (index != uint32(hashIndex)) {
+			return fmt.Errorf("hash %d %s is not in the lookup map", hashIndex, hash.ToString())
+		}
+	}
+	for key := range h.duplicates {
+		if _, ok := h.hashesLookup[key]; !ok {
+			return fmt.Errorf("occurrences of a hash which is not in the DB")
+		}
+	}
+
+	if len(h.multiIndexTables) != h.blocks {
+		return fmt.Errorf("%d index tables, expected %d", len(h.multiIndexTables), h.blocks)
+	}
+	postings := 0
+	for b, indexTable := range h.multiIndexTables {
+		if !h.config.UseMultiindex {
+			if len(indexTable) != 0 {
+				return fmt.Errorf("unexpected index table %d", b)
+			}
+			continue
+		}
+		var buffer [256]uint16
+		for blockValue, hashes := range indexTable {
+			for i, hashIndex := range hashes {
+				if (i > 0) && (hashes[i-1] >= hashIndex) {
+					return fmt.Errorf("block %d value %x: hashes are not sorted at %d", b, blockValue, i)
+				}
+				if (int(hashIndex) >= len(h.hashes)) || (h.hashes[hashIndex] == nil) {
+					return fmt.Errorf("block %d value %x: hash %d is out of range or removed", b, blockValue, hashIndex)
+				}
+				if h.blockValues(h.hashes[hashIndex], buffer[:0])[b] != blockValue {
+					return fmt.Errorf("block %d value %x: hash %d %s has another value", b, blockValue, hashIndex, h.hashes[hashIndex].ToString())
+				}
+			}
+			postings += len(hashes)
+		}
+	}
+	// Every hash appears once in every table
+	if h.config.UseMultiindex && (postings != h.blocks*count) {
+		return fmt.Errorf("%d entries in the index tables, expected %d", postings, h.blocks*count)
+	}
+	return nil
 }
 
 // Contains returns true if the hash is in the DB
 // This API is not reentrant and should not be called simultaneously
 // with add/remove
 func (h *H) Contains(hash FuzzyHash) bool {
-	key := hash.toKey()
-	_, ok := h.hashesLookup[key]
+	hash = hash.maskPadding(h.config.HashSize)
+	if !h.safeKeys {
+		_, ok := h.hashesLookup[hash.toKey()]
+		return ok
+	}
+	// Many threads can call Contains(), every thread uses own buffer
+	scratch := h.scratchPool.Get().(*queryScratch)
+	_, ok := h.lookup(scratch, hash)
+	h.scratchPool.Put(scratch)
 	return ok
 }
 
+// lookup returns the index of the hash in the DB. The hash shall have zero
+// padding. In the safe keys mode I build the key in the scratch buffer
+// The compiler does not allocate a string for the lookup
+func (h *H) lookup(scratch *queryScratch, hash FuzzyHash) (uint32, bool) {
+	if h.safeKeys {
+		scratch.keyBuffer = appendKey(scratch.keyBuffer[:0], hash)
+		hashIndex, ok := h.hashesLookup[string(scratch.keyBuffer)]
+		return hashIndex, ok
+	}
+	hashIndex, ok := h.hashesLookup[hash.toKey()]
+	return hashIndex, ok
+}
+
+// ContainsWithin returns true if there is a hash within the distance d in
+// the DB. I stop the search at the first such hash
+// The multi-index finds a hash for any d up to MaxDistance
+// This API is not reentrant and should not be called simultaneously
+// with add/remove. Many threads can call the API simultaneously
+func (h *H) ContainsWithin(hash FuzzyHash, d int) bool {
+	atomic.AddUint64(&h.statistics.ContainsWithin, 1)
+	hash = hash.maskPadding(h.config.HashSize)
+	found, candidates := false, uint64(0)
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		candidates++
+		found = h.hammingDistance(hash, candidateHash) <= d
+		return !found
+	})
+	atomic.AddUint64(&h.statistics.ContainsWithinCandidates, candidates)
+	return found
+}
+
+// DedupFilter returns a filter for a stream of hashes. The filter adds a
+// hash to the DB and returns true if there is no hash within maxDistance
+// in the DB. The filter returns false for the near duplicates and
+// the hashes of wrong size. The multi-index finds the near duplicates
+// for any maxDistance up to MaxDistance
+// The filter is not reentrant and should not be called simultaneously
+// with other APIs
+func (h *H) DedupFilter(maxDistance int) func(FuzzyHash) bool {
+	return func(hash FuzzyHash) bool {
+		if !h.validHash(hash) || h.ContainsWithin(hash, maxDistance) {
+			return false
+		}
+		return h.Add(hash)
+	}
+}
+
+// CountExisting returns how many of the hashes are in the DB. A hash which
+// appears in the batch twice counts twice. I do not modify the DB
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) CountExisting(hashes []FuzzyHash) int {
+	count := 0
+	for _, hash := range hashes {
+		if h.validHash(hash) && h.Contains(hash) {
+			count++
+		}
+	}
+	return count
+}
+
+// ContainsNear returns true if there is a hash within maxDistance in the DB
+// If a hash differs in at most maxDistance bits at least one of any
+// maxDistance+1 disjoint blocks matches. I probe only maxDistance+1 blocks
+// and stop at the first hash within maxDistance. If the multi-index can not
+// guarantee the result I check all hashes
+// This API is not reentrant and should not be called simultaneously
+// with add/remove. Many threads can call the API simultaneously
+func (h *H) ContainsNear(hash FuzzyHash, maxDistance int) bool {
+	if !h.validHash(hash) || (maxDistance < 0) {
+		return false
+	}
+	hash = hash.maskPadding(h.config.HashSize)
+	if h.Contains(hash) {
+		return true
+	}
+	useMultiindex := h.config.UseMultiindex && (h.config.BlockOverlap == 0) && (h.config.MaxBucketScan == 0) &&
+		(maxDistance < h.blocks)
+	if !useMultiindex {
+		for _, candidateHash := range h.hashes {
+			if (candidateHash != nil) && (h.hammingDistance(hash, candidateHash) <= maxDistance) {
+				return true
+			}
+		}
+		return false
+	}
+	var buffer [256]uint16
+	blockValues := h.blockValues(hash, buffer[:0])
+	for b, blockValue := range blockValues[:maxDistance+1] {
+		for _, candidateIndex := range h.multiIndexTables[b][blockValue] {
+			candidateHash := h.hashes[candidateIndex]
+			if (candidateHash != nil) && (h.hammingDistance(hash, candidateHash) <= maxDistance) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Occurrences returns the number of times the hash was added to the DB
+// I return 0 if the hash is not in the DB
+func (h *H) Occurrences(hash FuzzyHash) int {
+	if !h.Contains(hash) {
+		return 0
+	}
+	hash = hash.maskPadding(h.config.HashSize)
+	return 1 + int(h.duplicates[hash.toKey()])
+}
+
 func (h *H) Config() Config {
 	return h.config
 }
@@ -544,25 +1822,187 @@ func (h *H) Config() Config {
 // ShortestDistance returns the closest sibling in the DB for
 // the specfied hash
 // This API is not reentrant and should not be called simultaneously
-// with add/remove
+// with add/remove. Many threads can call the API simultaneously
 func (h *H) ShortestDistance(hash FuzzyHash) Sibling {
-	statistics.Distance++
-	statistics.PendingDistance++
-	defer func() {
-		statistics.PendingDistance--
-	}()
+	return h.shortestDistance(nil, hash)
+}
 
-	// Do I have this hash already?
-	if h.Contains(hash) {
-		statistics.DistanceContains++
-		return Sibling{distance: 0, s: hash}
+// ShortestDistanceCtx is ShortestDistance() which uses the buffers in the
+// context and does not allocate. The query shall not be modified until the
+// call returns. An exact match returns the hash stored in the DB
+// This API is not reentrant and should not be called simultaneously
+// with add/remove. Many threads can call the API simultaneously, every
+// thread with own context
+func (h *H) ShortestDistanceCtx(ctx *ReadCtx, hash FuzzyHash) Sibling {
+	return h.shortestDistance(ctx, hash)
+}
+
+// shortestDistance uses the buffers in the context if the context is not nil
+func (h *H) shortestDistance(ctx *ReadCtx, hash FuzzyHash) Sibling {
+	atomic.AddUint64(&h.statistics.Distance, 1)
+	atomic.AddUint64(&h.statistics.PendingDistance, 1)
+	defer atomic.AddUint64(&h.statistics.PendingDistance, ^uint64(0))
+
+	var sibling Sibling
+	if ctx == nil {
+		hash = hash.maskPadding(h.config.HashSize)
+		// Do I have this hash already?
+		if h.Contains(hash) {
+			atomic.AddUint64(&h.statistics.DistanceContains, 1)
+			atomic.AddUint64(&h.statistics.ExactMatches, 1)
+			return Sibling{distance: 0, s: hash}
+		}
+		sibling = h.Distance(hash)
+	} else {
+		hash = ctx.maskPadding(hash, h.config.HashSize)
+		if hashIndex, ok := h.lookup(&ctx.scratch, hash); ok {
+			atomic.AddUint64(&h.statistics.DistanceContains, 1)
+			atomic.AddUint64(&h.statistics.ExactMatches, 1)
+			return Sibling{distance: 0, s: h.hashes[hashIndex]}
+		}
+		sibling = Sibling{distance: h.config.HashSize}
+		if h.validHash(hash) && h.config.UseMultiindex {
+			sibling = h.shortestDistanceMultiindexScratch(&ctx.scratch, hash)
+		} else if h.validHash(hash) {
+			sibling = h.shortestDistanceBruteForce(hash)
+		}
+	}
+	switch {
+	case sibling.s != nil && sibling.distance == 0:
+		atomic.AddUint64(&h.statistics.ExactMatches, 1)
+	case sibling.s != nil && sibling.distance <= h.config.MaxDistance:
+		atomic.AddUint64(&h.statistics.WithinThreshold, 1)
+	default:
+		atomic.AddUint64(&h.statistics.BeyondThreshold, 1)
+	}
+	return sibling
+}
+
+// ShortestDistanceOK returns the result of ShortestDistance() and false if
+// there is no sibling at all: the DB is empty, the hash is of a wrong size
+// or the multi-index found no candidates
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ShortestDistanceOK(hash FuzzyHash) (Sibling, bool) {
+	sibling := h.ShortestDistance(hash)
+	return sibling, sibling.s != nil
+}
+
+// ShortestDistanceExact returns the result of ShortestDistance() and true
+// if the distance is zero. The exact match costs a single lookup
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ShortestDistanceExact(hash FuzzyHash) (Sibling, bool) {
+	sibling := h.ShortestDistance(hash)
+	return sibling, (sibling.s != nil) && (sibling.distance == 0)
+}
+
+// count increments a counter of add/remove, see Config.AtomicStats
+func (h *H) count(counter *uint64) {
+	if h.config.AtomicStats {
+		atomic.AddUint64(counter, 1)
+		return
 	}
+	*counter++
+}
+
+// Stats returns the counters of the instance
+// Many threads can call the API simultaneously
+func (h *H) Stats() Statistics {
+	return h.statistics.snapshot(false)
+}
+
+// StatsAndReset returns the counters of the instance and zeroes the
+// counters. I swap every counter atomically, a query running
+// simultaneously is counted either in this snapshot or in the next one
+// Many threads can call the API simultaneously
+func (h *H) StatsAndReset() Statistics {
+	return h.statistics.snapshot(true)
+}
+
+// ResetStats zeroes the counters of the instance
+// Many threads can call the API simultaneously
+func (h *H) ResetStats() {
+	h.statistics.snapshot(true)
+}
 
-	sibling := h.Distance(hash)
+// ShortestDistanceMulti returns the closest sibling for any of the
+// specified hashes. A sibling found for an earlier hash wins a tie
+// This API is not reentrant and should not be called simultaneously
+// with add/remove. Many threads can call the API simultaneously
+func (h *H) ShortestDistanceMulti(queries []FuzzyHash) Sibling {
+	sibling := Sibling{
+		distance: h.config.HashSize,
+	}
+	for _, query := range queries {
+		if candidate := h.ShortestDistance(query); (candidate.s != nil) && ((sibling.s == nil) || (candidate.distance < sibling.distance)) {
+			sibling = candidate
+		}
+		if (sibling.s != nil) && (sibling.distance == 0) {
+			break
+		}
+	}
 	return sibling
 }
 
+// ShortestDistanceWithBlockMatches returns the closest sibling and the number of
+// blocks the sibling shares with the specified hash
+// More blocks in common usually means a closer match. The number is a cheap
+// relevance signal
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ShortestDistanceWithBlockMatches(hash FuzzyHash) (Sibling, int) {
+	sibling := h.ShortestDistance(hash)
+	if sibling.s == nil {
+		return sibling, 0
+	}
+	return sibling, h.matchingBlocks(hash, sibling.s)
+}
+
+// ScoreCandidate returns the hamming distance between the hashes and the
+// number of blocks with the same value in both hashes. I XOR the hashes once
+// and count the bits and the zero blocks of the XOR
+// I return HashSize and 0 if the hashes are of a wrong size
+func (h *H) ScoreCandidate(query, candidate FuzzyHash) (distance, matchingBlocks int) {
+	if !h.validHash(query) || !h.validHash(candidate) {
+		return h.config.HashSize, 0
+	}
+	var buffer [8]uint64
+	xor := FuzzyHash(buffer[:0])
+	for i := range query {
+		xor = append(xor, query[i]^candidate[i])
+	}
+	xor[0] &^= xor.paddingMask(h.config.HashSize)
+	for _, v := range xor {
+		distance += bits.OnesCount64(v)
+	}
+	for b := 0; b < h.blocks; b++ {
+		if h.blockValue(xor, b) == 0 {
+			matchingBlocks++
+		}
+	}
+	return distance, matchingBlocks
+}
+
+// matchingBlocks counts blocks with the same value in both hashes
+func (h *H) matchingBlocks(hash FuzzyHash, candidate FuzzyHash) int {
+	var hashBuffer, candidateBuffer [256]uint16
+	hashBlockValues := h.blockValues(hash, hashBuffer[:0])
+	candidateBlockValues := h.blockValues(candidate, candidateBuffer[:0])
+	matches := 0
+	for b, blockValue := range hashBlockValues {
+		if blockValue == candidateBlockValues[b] {
+			matches++
+		}
+	}
+	return matches
+}
+
 func (h *H) Distance(hash FuzzyHash) Sibling {
+	if !h.validHash(hash) {
+		return Sibling{distance: h.config.HashSize}
+	}
+	hash = hash.maskPadding(h.config.HashSize)
 	sibling := h.distance(h, hash)
 	return sibling
 }
@@ -587,21 +2027,57 @@ func (h *H) shortestDistanceBruteForce(hash FuzzyHash) Sibling {
 	sibling := Sibling{
 		distance: h.config.HashSize,
 	}
-	statistics.DistanceCandidates += uint64(len(h.hashes))
+	betterCandidates := uint64(0)
+	ties := 0
+	candidates := 0
+	// The removed hashes do not count towards MaxCandidates
+	approximate := (h.config.MaxCandidates > 0) && (len(h.hashesLookup) > h.config.MaxCandidates)
 	for _, candidateHash := range h.hashes {
-		hammingDistance := distanceUint64s(hash, candidateHash)
+		if candidateHash == nil { // removed
+			continue
+		}
+		if approximate && (candidates == h.config.MaxCandidates) {
+			break
+		}
+		candidates++
+		hammingDistance := h.hammingDistance(hash, candidateHash)
 		if hammingDistance < sibling.distance {
-			statistics.DistanceBetterCandidate++
+			betterCandidates++
+			ties = 1
 			sibling = Sibling{
 				s:        candidateHash,
 				distance: hammingDistance,
 			}
+		} else if hammingDistance == sibling.distance {
+			ties++
+			if h.breakTie(candidateHash, sibling.s, ties) {
+				sibling = Sibling{
+					s:        candidateHash,
+					distance: hammingDistance,
+				}
+			}
 		}
 	}
+	atomic.AddUint64(&h.statistics.DistanceCandidates, uint64(candidates))
+	atomic.AddUint64(&h.statistics.DistanceBetterCandidate, betterCandidates)
+	h.checkSlowQuery(hash, candidates)
+	if approximate {
+		sibling.approximate = true
+		atomic.AddUint64(&h.statistics.DistanceApproximate, 1)
+	}
 	return sibling
 }
 
 func (h *H) shortestDistanceMultiindex(hash FuzzyHash) Sibling {
+	scratch := h.scratchPool.Get().(*queryScratch)
+	defer h.scratchPool.Put(scratch)
+	return h.shortestDistanceMultiindexScratch(scratch, hash)
+}
+
+// shortestDistanceMultiindexScratch uses the scratch for the book keeping of
+// the checked candidates
+func (h *H) shortestDistanceMultiindexScratch(scratch *queryScratch, hash FuzzyHash) Sibling {
+	h.resetScratch(scratch)
 	sibling := Sibling{
 		distance: h.config.HashSize,
 	}
@@ -609,51 +2085,391 @@ func (h *H) shortestDistanceMultiindex(hash FuzzyHash) Sibling {
 	// for all 7 bits sub-strings in the 'hash'
 	// find all hashes  containing exactly the same hash
 	// Choose a sibling with the minimum hamming distance from the 'hash'
-	blockMask := (uint64(1) << uint64(h.blockSize)) - 1
-	hashOrig := hash
-	hash = hash.Dup()
+	betterCandidates := uint64(0)
+	ties := 0
+	candidates, approximate := 0, false
+	h.visitIndex(scratch, hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		if (h.config.MaxCandidates > 0) && (candidates == h.config.MaxCandidates) {
+			approximate = true
+			return false
+		}
+		candidates++
+		hammingDistance := h.hammingDistance(hash, candidateHash)
+		if hammingDistance < sibling.distance {
+			betterCandidates++
+			ties = 1
+			sibling = Sibling{
+				s:        candidateHash,
+				distance: hammingDistance,
+			}
+		} else if hammingDistance == sibling.distance {
+			ties++
+			if h.breakTie(candidateHash, sibling.s, ties) {
+				sibling = Sibling{
+					s:        candidateHash,
+					distance: hammingDistance,
+				}
+			}
+		}
+		return true
+	})
+	atomic.AddUint64(&h.statistics.DistanceBetterCandidate, betterCandidates)
+	h.updateMaxCandidates(candidates)
+	h.checkSlowQuery(hash, candidates)
+	if approximate {
+		sibling.approximate = true
+		atomic.AddUint64(&h.statistics.DistanceApproximate, 1)
+	}
+	return sibling
+}
+
+// breakTie returns true if the candidate replaces the sibling at the same
+// distance, see Config.TieBreaker and Config.RandomizeTies
+func (h *H) breakTie(candidate, current FuzzyHash, ties int) bool {
+	if h.config.TieBreaker != nil {
+		return (current != nil) && h.config.TieBreaker(candidate, current)
+	}
+	if h.config.RandomizeTies {
+		return h.pickTie(ties)
+	}
+	return (current != nil) && candidate.less(current)
+}
+
+// pickTie returns true with probability 1/ties. The sibling is chosen
+// uniformly among the candidates at the same distance
+func (h *H) pickTie(ties int) bool {
+	h.randomMutex.Lock()
+	pick := h.random.Intn(ties) == 0
+	h.randomMutex.Unlock()
+	return pick
+}
+
+// updateMaxCandidates raises the high-water mark of the candidates
+func (h *H) updateMaxCandidates(candidates int) {
+	for {
+		seen := atomic.LoadUint64(&h.statistics.MaxCandidatesSeen)
+		if uint64(candidates) <= seen {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&h.statistics.MaxCandidatesSeen, seen, uint64(candidates)) {
+			return
+		}
+	}
+}
+
+// checkSlowQuery calls Config.OnSlowQuery if the query checked too many
+// candidates
+func (h *H) checkSlowQuery(hash FuzzyHash, candidates int) {
+	if (h.config.SlowQueryThreshold > 0) && (candidates > h.config.SlowQueryThreshold) && (h.config.OnSlowQuery != nil) {
+		h.config.OnSlowQuery(hash, candidates)
+	}
+}
+
+// visitCandidates calls visit() once for every candidate. In the multi-index
+// mode the candidates are hashes which share at least one block with the
+// specified hash, I skip buckets larger than Config.MaxBucketScan. In the
+// brute force mode all hashes are candidates
+// Function visit() returns false to stop the search
+func (h *H) visitCandidates(hash FuzzyHash, visit func(candidateIndex uint32, candidateHash FuzzyHash) bool) {
+	if !h.validHash(hash) {
+		return
+	}
+	if !h.config.UseMultiindex {
+		for candidateIndex, candidateHash := range h.hashes {
+			if candidateHash == nil { // removed
+				continue
+			}
+			if !visit(uint32(candidateIndex), candidateHash) {
+				atomic.AddUint64(&h.statistics.DistanceCandidates, uint64(candidateIndex+1))
+				return
+			}
+		}
+		atomic.AddUint64(&h.statistics.DistanceCandidates, uint64(len(h.hashes)))
+		return
+	}
+
+	// Keeping map of already checked hashes improves performance by 10%
+	scratch := h.getScratch()
+	h.visitIndex(scratch, hash, visit)
+	h.scratchPool.Put(scratch)
+}
+
+// visitIndex calls visit() once for every candidate in the multi-index
+// The scratch shall be reset for the query
+func (h *H) visitIndex(scratch *queryScratch, hash FuzzyHash, visit func(candidateIndex uint32, candidateHash FuzzyHash) bool) {
+	var buffer [256]uint16
+	blockValues := h.blockValues(hash, buffer[:0])
 	//fmt.Printf("%v\n", h.multiIndexTables)
 	//fmt.Printf("disatnce.h.hashes=%v\n", h.hashes)
 
-	// Keeping map of already checked hashes improves performance by 10%
-	checkedCandidates := make([]int, len(h.hashes))
-	for b := uint8(0); b < uint8(h.blocks); b++ {
-		blockValue := hash.and(blockMask)
-		hash.rsh(uint64(h.blockSize))
+	checkedCandidates, generation := scratch.checkedCandidates, scratch.generation
+
+	// I update the shared counters once per query
+	var noIndex, noCandidates, candidatesCount, alreadyChecked, skippedBuckets uint64
+search:
+	for i := range blockValues {
+		b := i
+		if h.blockOrder != nil {
+			b = h.blockOrder[i]
+		}
+		blockValue := blockValues[b]
 		indexTable := h.multiIndexTables[b]
 		if indexTable == nil {
-			statistics.DistanceNoIndex++
+			noIndex++
 			continue
 		}
-		candidates, ok := indexTable[uint16(blockValue)]
+		candidates, ok := indexTable[blockValue]
 		if !ok {
-			statistics.DistanceNoCandidates++
+			noCandidates++
+			continue
+		}
+		if (h.config.MaxBucketScan > 0) && (len(candidates) > h.config.MaxBucketScan) {
+			skippedBuckets++
 			continue
 		}
-		statistics.DistanceCandidates += uint64(len(candidates))
+		candidatesCount += uint64(len(candidates))
 		for _, candidateIndex := range candidates {
-			checkedCandidates[candidateIndex]++
-			if checkedCandidates[candidateIndex] > 1 {
-				statistics.DistanceAlreadyChecked++
+			if checkedCandidates[candidateIndex] == generation {
+				alreadyChecked++
 				continue
 			}
-			candidateHash := h.hashes[candidateIndex]
-			hammingDistance := distanceUint64s(hashOrig, candidateHash)
-			// fmt.Printf("Sample %s Candidate %s distance %d blockV=%x hash=%s\n",
-			//	hashOrig.ToString(), candidateHash.ToString(), hammingDistance, blockValue, hash.ToString())
-			if hammingDistance < sibling.distance {
-				statistics.DistanceBetterCandidate++
+			checkedCandidates[candidateIndex] = generation
+			if h.hashes[candidateIndex] == nil { // removed
+				continue
+			}
+			if h.config.DebugOutput != nil {
+				scratch.debugBuffer = h.debugCandidate(scratch.debugBuffer[:0], hash, h.hashes[candidateIndex], blockValue)
+			}
+			if !visit(candidateIndex, h.hashes[candidateIndex]) {
+				break search
+			}
+		}
+	}
+
+	atomic.AddUint64(&h.statistics.DistanceNoIndex, noIndex)
+	atomic.AddUint64(&h.statistics.DistanceNoCandidates, noCandidates)
+	atomic.AddUint64(&h.statistics.DistanceCandidates, candidatesCount)
+	atomic.AddUint64(&h.statistics.DistanceAlreadyChecked, alreadyChecked)
+	atomic.AddUint64(&h.statistics.DistanceSkippedBuckets, skippedBuckets)
+}
+
+// debugCandidate writes "Sample <hash> Candidate <hash> blockV=<value>"
+// to the debug output. I return the buffer for reuse
+func (h *H) debugCandidate(buffer []byte, hash FuzzyHash, candidateHash FuzzyHash, blockValue uint16) []byte {
+	buffer = append(buffer, "Sample "...)
+	buffer = hash.AppendHex(buffer)
+	buffer = append(buffer, " Candidate "...)
+	buffer = candidateHash.AppendHex(buffer)
+	buffer = append(buffer, " blockV="...)
+	buffer = FuzzyHash{uint64(blockValue)}.AppendHex(buffer)
+	buffer = append(buffer, '\n')
+	h.config.DebugOutput.Write(buffer)
+	return buffer
+}
+
+// ShortestDistanceScored returns the candidate with the minimal score
+// Function score() combines the hamming distance with the application data
+// The multi-index collects the candidates, score() ranks them. I do not
+// apply the tie breaking of ShortestDistance(), the first candidate found
+// with the minimal score wins
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ShortestDistanceScored(hash FuzzyHash, score func(candidate FuzzyHash, distance int) float64) Sibling {
+	sibling := Sibling{
+		distance: h.config.HashSize,
+	}
+	bestScore := 0.0
+	hash = hash.maskPadding(h.config.HashSize)
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		hammingDistance := h.hammingDistance(hash, candidateHash)
+		candidateScore := score(candidateHash, hammingDistance)
+		if (sibling.s == nil) || (candidateScore < bestScore) {
+			bestScore = candidateScore
+			sibling = Sibling{
+				s:        candidateHash,
+				distance: hammingDistance,
+			}
+		}
+		return true
+	})
+	return sibling
+}
+
+// ShortestDistanceStream calls onBetter() every time the search finds a
+// candidate closer than all candidates found before or a candidate at the
+// same distance which wins the tie like in ShortestDistance(). The last
+// call reports the closest sibling
+// The application can show the improving results while the search runs
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) ShortestDistanceStream(hash FuzzyHash, onBetter func(Sibling)) {
+	atomic.AddUint64(&h.statistics.Distance, 1)
+	sibling := Sibling{
+		distance: h.config.HashSize,
+	}
+	hash = hash.maskPadding(h.config.HashSize)
+	betterCandidates := uint64(0)
+	ties := 0
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		hammingDistance := h.hammingDistance(hash, candidateHash)
+		if hammingDistance < sibling.distance {
+			betterCandidates++
+			ties = 1
+			sibling = Sibling{
+				s:        candidateHash,
+				distance: hammingDistance,
+			}
+			onBetter(sibling)
+		} else if hammingDistance == sibling.distance {
+			ties++
+			if h.breakTie(candidateHash, sibling.s, ties) {
 				sibling = Sibling{
 					s:        candidateHash,
 					distance: hammingDistance,
 				}
+				onBetter(sibling)
 			}
 		}
+		// Nothing can be closer than an exact match
+		return sibling.distance > 0
+	})
+	atomic.AddUint64(&h.statistics.DistanceBetterCandidate, betterCandidates)
+}
+
+// Within returns all siblings within the distance d sorted by distance
+// Siblings at the same distance are in the order of insertion
+// The multi-index finds all siblings if d does not exceed MaxDistance. For
+// a larger d the multi-index can miss siblings which share no block with
+// the query
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) Within(hash FuzzyHash, d int) []Sibling {
+	atomic.AddUint64(&h.statistics.Distance, 1)
+	hash = hash.maskPadding(h.config.HashSize)
+	var siblings []Sibling
+	var indexes []uint32
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		if hammingDistance := h.hammingDistance(hash, candidateHash); hammingDistance <= d {
+			siblings = append(siblings, Sibling{s: candidateHash, distance: hammingDistance})
+			indexes = append(indexes, candidateIndex)
+		}
+		return true
+	})
+	sort.Sort(siblingsByDistance{siblings, indexes})
+	return siblings
+}
+
+// siblingsByDistance sorts the siblings by distance and by the index
+// of the hash
+type siblingsByDistance struct {
+	siblings []Sibling
+	indexes  []uint32
+}
+
+func (sd siblingsByDistance) Len() int { return len(sd.siblings) }
+func (sd siblingsByDistance) Less(i, j int) bool {
+	if sd.siblings[i].distance != sd.siblings[j].distance {
+		return sd.siblings[i].distance < sd.siblings[j].distance
+	}
+	return sd.indexes[i] < sd.indexes[j]
+}
+func (sd siblingsByDistance) Swap(i, j int) {
+	sd.siblings[i], sd.siblings[j] = sd.siblings[j], sd.siblings[i]
+	sd.indexes[i], sd.indexes[j] = sd.indexes[j], sd.indexes[i]
+}
+
+// AllShortest returns all siblings at the minimal distance in the order of
+// insertion. ShortestDistance() picks one of these siblings, see
+// Config.TieBreaker
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) AllShortest(hash FuzzyHash) []Sibling {
+	atomic.AddUint64(&h.statistics.Distance, 1)
+	hash = hash.maskPadding(h.config.HashSize)
+	distance := h.config.HashSize + 1
+	var indexes []uint32
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		hammingDistance := h.hammingDistance(hash, candidateHash)
+		if hammingDistance < distance {
+			distance = hammingDistance
+			indexes = indexes[:0]
+		}
+		if hammingDistance == distance {
+			indexes = append(indexes, candidateIndex)
+		}
+		return true
+	})
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	siblings := make([]Sibling, len(indexes))
+	for i, hashIndex := range indexes {
+		siblings[i] = Sibling{s: h.hashes[hashIndex], distance: distance}
 	}
+	return siblings
+}
 
+// siblingsHeap is a max-heap of siblings, the farthest sibling is on
+// the top
+type siblingsHeap []Sibling
+
+func (sh siblingsHeap) Len() int            { return len(sh) }
+func (sh siblingsHeap) Less(i, j int) bool  { return sh[j].isCloser(sh[i]) }
+func (sh siblingsHeap) Swap(i, j int)       { sh[i], sh[j] = sh[j], sh[i] }
+func (sh *siblingsHeap) Push(x interface{}) { *sh = append(*sh, x.(Sibling)) }
+func (sh *siblingsHeap) Pop() interface{} {
+	old := *sh
+	sibling := old[len(old)-1]
+	*sh = old[:len(old)-1]
 	return sibling
 }
 
+// isCloser returns true if the sibling is closer than the other sibling
+// I break the ties by the hash value, the smaller hash is closer
+func (sibling Sibling) isCloser(other Sibling) bool {
+	if sibling.distance != other.distance {
+		return sibling.distance < other.distance
+	}
+	return sibling.s.less(other.s)
+}
+
+// less compares the words of the hashes of the same size, the first word
+// is the most significant
+func (fh FuzzyHash) less(other FuzzyHash) bool {
+	for i := range fh {
+		if fh[i] != other[i] {
+			return fh[i] < other[i]
+		}
+	}
+	return false
+}
+
+// KNearest returns up to k closest siblings sorted by distance. Siblings at
+// the same distance are sorted by the hash value
+// I keep k best candidates in a heap and do not sort all candidates
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) KNearest(hash FuzzyHash, k int) []Sibling {
+	if k <= 0 {
+		return nil
+	}
+	hash = hash.maskPadding(h.config.HashSize)
+	best := make(siblingsHeap, 0, k)
+	h.visitCandidates(hash, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		sibling := Sibling{s: candidateHash, distance: h.hammingDistance(hash, candidateHash)}
+		if len(best) < k {
+			heap.Push(&best, sibling)
+		} else if sibling.isCloser(best[0]) {
+			best[0] = sibling
+			heap.Fix(&best, 0)
+		}
+		return true
+	})
+	siblings := make([]Sibling, len(best))
+	for i := len(siblings) - 1; i >= 0; i-- {
+		siblings[i] = heap.Pop(&best).(Sibling)
+	}
+	return siblings
+}
+
 // Dup allocates RAM and copies the tables
 // This API is not reentrant and should not be called simultaneously
 // with add/remove
@@ -662,7 +2478,10 @@ func (h *H) Dup() *H {
 	newH.hashes = make([]FuzzyHash, len(h.hashes))
 	copy(newH.hashes, h.hashes)
 	for blockIndex, indexTable := range h.multiIndexTables {
-		tmpIndexTable := make(map[uint16]([]uint32))
+		if indexTable == nil {
+			continue
+		}
+		tmpIndexTable := make(map[uint16]([]uint32), len(indexTable))
 		newH.multiIndexTables[blockIndex] = tmpIndexTable
 		for blockValue, hashes := range indexTable {
 			tmpIndexTable[blockValue] = make([]uint32, len(hashes))
@@ -672,5 +2491,18 @@ func (h *H) Dup() *H {
 	for key, value := range h.hashesLookup {
 		newH.hashesLookup[key] = value
 	}
+	for key, value := range h.duplicates {
+		newH.duplicates[key] = value
+	}
+	newH.safeKeys = h.safeKeys
+	newH.blockOrder = h.blockOrder // I never modify the order in place
+	// The clone replaces the original, the clone keeps counting
+	*newH.statistics = h.Stats()
+	// The application modifies the clone, the clone shares the log and
+	// uses own buffer for the records
+	newH.wal, newH.walErr = h.wal, h.walErr
+	if h.walRecord != nil {
+		newH.walRecord = make([]byte, len(h.walRecord))
+	}
 	return newH
 }
@@ -5,14 +5,21 @@ package hamming
 
 import (
 	"bufio"
+	"encoding/hex"
 	"flag"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"math/bits"
 	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/larytet-go/sprintf"
 	"github.com/steakknife/hamming"
@@ -72,6 +79,8 @@ var hashStringToFuzzyHashTests = []HashStringToFuzzyHashTest{
 	{in: "11223344556677881122334455667788", out: FuzzyHash{0x1122334455667788, 0x1122334455667788}},
 	{in: "11223344056677800022334455667088", out: FuzzyHash{0x1122334405667780, 0x0022334455667088}},
 	{in: "00000000000000000000000000000011", out: FuzzyHash{0x00, 0x11}},
+	{in: "112233445566778811223344556677", out: FuzzyHash{0x1122334455667788}, raiseError: true},
+	{in: "11223344556677", out: FuzzyHash{}, raiseError: true},
 }
 
 func TestHashStringToFuzzyHash(t *testing.T) {
@@ -80,6 +89,9 @@ func TestHashStringToFuzzyHash(t *testing.T) {
 		if err != nil && !test.raiseError {
 			t.Errorf("Test %d failed: %v", testID, err)
 		}
+		if err == nil && test.raiseError {
+			t.Errorf("Test %d failed: expected an error for '%s'", testID, test.in)
+		}
 		if !fh.IsEqual(test.out) && !test.raiseError {
 			t.Errorf("Test %d failed: expected %s, got %s", testID, test.out.ToString(), fh.ToString())
 		}
@@ -96,8 +108,37 @@ type BytesToFuzzyHashTest struct {
 }
 
 var bytesToFuzzyHashTests = []BytesToFuzzyHashTest{
-	{in: []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}, out: FuzzyHash{0x8877665544332211}},
-	{in: []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77},       out: FuzzyHash{0x8877665544332211}, raiseError: true},
+	{in: []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}, out: FuzzyHash{0x1122334455667788}},
+	{in: []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77},       out: FuzzyHash{0x1122334455667788}, raiseError: true},
+}
+
+var hashStringToFuzzyHashTrimBracesTests = []struct {
+	in         string
+	out        string
+	raiseError bool
+}{
+	{"{" + allFsHash + "}", allFsHash, false},
+	{"7B" + allFsHash + "7D", allFsHash, false},
+	{"7b" + allFsHash + "7d", allFsHash, false},
+	{allFsHash, allFsHash, false},
+	// A clean hash which looks like wrapped
+	{"7B" + allFsHash[4:] + "7D", "7B" + allFsHash[4:] + "7D", false},
+	{"{" + allFsHash, "", true},
+	{"7B" + allFsHash, "", true},
+	{"{}", "", false},
+}
+
+func TestHashStringToFuzzyHashTrimBraces(t *testing.T) {
+	for testID, test := range hashStringToFuzzyHashTrimBracesTests {
+		fh, err := HashStringToFuzzyHashTrimBraces(test.in)
+		if (err != nil) != test.raiseError {
+			t.Errorf("Test %d: unexpected error %v", testID, err)
+			continue
+		}
+		if !test.raiseError && !strings.EqualFold(fh.ToString(), test.out) {
+			t.Errorf("Test %d: expected %s, got %s", testID, test.out, fh.ToString())
+		}
+	}
 }
 
 func TestBytesToFuzzyHash(t *testing.T) {
@@ -112,6 +153,100 @@ func TestBytesToFuzzyHash(t *testing.T) {
 	}
 }
 
+func TestBytesToFuzzyHashMatchesHexString(t *testing.T) {
+	for testID, test := range hashStringToFuzzyHashTests {
+		if test.raiseError || len(test.in)%16 != 0 {
+			continue
+		}
+		fromString, _ := HashStringToFuzzyHash(test.in)
+		data, err := hex.DecodeString(test.in)
+		if err != nil {
+			t.Fatalf("Test %d: %v", testID, err)
+		}
+		fromBytes, err := BytesToFuzzyHash(data)
+		if err != nil || !fromBytes.IsEqual(fromString) {
+			t.Errorf("Test %d failed: expected %s, got %s %v", testID, fromString.ToString(), fromBytes.ToString(), err)
+		}
+		if again, _ := BytesToFuzzyHash(fromString.Bytes()); !again.IsEqual(fromString) {
+			t.Errorf("Test %d failed: expected %s, got %s", testID, fromString.ToString(), again.ToString())
+		}
+	}
+}
+
+func TestFuzzyHashBytes(t *testing.T) {
+	for testID, test := range bytesToFuzzyHashTests {
+		if !test.raiseError && !reflect.DeepEqual(test.out.Bytes(), test.in) {
+			t.Errorf("Test %d failed: expected %v, got %v", testID, test.in, test.out.Bytes())
+		}
+	}
+	hashes := []FuzzyHash{
+		{},
+		{0x8000000000000000},
+		{0xFFFFFFFFFFFFFFFF, 0x00, 0x8000000000000001},
+		{0x1122334455667788, 0x99AABBCCDDEEFF00, 0xF0E1D2C3B4A59687, 0x0102030405060708},
+	}
+	for testID, hash := range hashes {
+		fh, err := BytesToFuzzyHash(hash.Bytes())
+		if err != nil || !fh.IsEqual(hash) {
+			t.Errorf("Test %d failed: expected %s, got %s %v", testID, hash.ToString(), fh.ToString(), err)
+		}
+	}
+}
+
+func TestFuzzyHashFromBigInt(t *testing.T) {
+	for testID, test := range hashStringToFuzzyHashTests {
+		if test.raiseError {
+			continue
+		}
+		n, _ := new(big.Int).SetString(test.in, 16)
+		fh, err := FuzzyHashFromBigInt(n, 4*len(test.in))
+		if err != nil || !fh.IsEqual(test.out) {
+			t.Errorf("Test %d failed: expected %s, got %s %v", testID, test.out.ToString(), fh.ToString(), err)
+		}
+		if fh.BigInt().Cmp(n) != 0 {
+			t.Errorf("Test %d failed: expected %s, got %s", testID, n.Text(16), fh.BigInt().Text(16))
+		}
+	}
+
+	// The top bit and the padding
+	top := new(big.Int).Lsh(big.NewInt(1), 255)
+	fh, err := FuzzyHashFromBigInt(top, 256)
+	if err != nil || !fh.IsEqual(FuzzyHash{0x8000000000000000, 0x00, 0x00, 0x00}) || fh.BigInt().Cmp(top) != 0 {
+		t.Errorf("Expected the top bit, got %s %v", fh.ToString(), err)
+	}
+	if fh, _ := FuzzyHashFromBigInt(big.NewInt(0x11), 200); !fh.IsEqual(FuzzyHash{0x00, 0x00, 0x00, 0x11}) {
+		t.Errorf("Expected a padded hash, got %s", fh.ToString())
+	}
+	if _, err := FuzzyHashFromBigInt(top, 255); err == nil {
+		t.Errorf("Expected an error for a 256 bits value")
+	}
+	if _, err := FuzzyHashFromBigInt(big.NewInt(-1), 64); err == nil {
+		t.Errorf("Expected an error for a negative value")
+	}
+}
+
+func TestFromUint64s(t *testing.T) {
+	words := []uint64{0x1122334455667788, 0x00, 0x00, 0x01}
+	fh, err := FromUint64s(words, 256)
+	if err != nil {
+		t.Fatalf("Failed to create a hash: %v", err)
+	}
+	if !fh.IsEqual(words) {
+		t.Errorf("Expected %v, got %s", words, fh.ToString())
+	}
+	words[0] = 0
+	if fh[0] != 0x1122334455667788 {
+		t.Errorf("The hash shares the words with the caller")
+	}
+
+	if _, err := FromUint64s(words, 128); err == nil {
+		t.Errorf("Expected an error for 4 words and 128 bits")
+	}
+	if _, err := FromUint64s(words[:3], 256); err == nil {
+		t.Errorf("Expected an error for 3 words and 256 bits")
+	}
+}
+
 func TestFuzzyHashAnd(t *testing.T) {
 	fh := FuzzyHash{0x3031323334353637, 0x3736353433323130}
 	mask := uint64(0xFF01)
@@ -123,6 +258,79 @@ func TestFuzzyHashAnd(t *testing.T) {
 	}
 }
 
+type FuzzyHashLeadingZerosTest struct {
+	in    FuzzyHash
+	zeros int
+}
+
+var fuzzyHashLeadingZerosTests = []FuzzyHashLeadingZerosTest{
+	{in: allZerosHashBin, zeros: 256},
+	{in: FuzzyHash{}, zeros: 0},
+	{in: FuzzyHash{0x8000000000000000, 0x00, 0x00, 0x00}, zeros: 0},
+	{in: FuzzyHash{0x0000000000000001, 0x00, 0x00, 0x00}, zeros: 63},
+	{in: FuzzyHash{0x00, 0x0000100000000000, 0x00, 0x01}, zeros: 64 + 19},
+	{in: FuzzyHash{0x00, 0x00, 0x00, 0x01}, zeros: 255},
+}
+
+func TestFuzzyHashLeadingZeros(t *testing.T) {
+	for testID, test := range fuzzyHashLeadingZerosTests {
+		if zeros := test.in.LeadingZeros(); zeros != test.zeros {
+			t.Errorf("Test %d failed: expected %d, got %d", testID, test.zeros, zeros)
+		}
+	}
+	if zeros := allZerosHashBin.LeadingZeros(); zeros != allZerosHashBin.Bits() {
+		t.Errorf("Expected %d, got %d", allZerosHashBin.Bits(), zeros)
+	}
+}
+
+func TestFuzzyHashComparable(t *testing.T) {
+	for testID, test := range distanceTests {
+		if comparable := test.a.Comparable(test.b); comparable == test.raiseError {
+			t.Errorf("Test %d: expected %v, got %v", testID, !test.raiseError, comparable)
+		}
+		if test.a.Comparable(test.b) != test.b.Comparable(test.a) {
+			t.Errorf("Test %d: expected a symmetric result", testID)
+		}
+	}
+}
+
+func TestFuzzyHashXor(t *testing.T) {
+	for testID, test := range distanceTests {
+		xor, err := test.a.Xor(test.b)
+		if (err != nil) != test.raiseError {
+			t.Errorf("Test %d: expected error %v, got %v", testID, test.raiseError, err)
+			continue
+		}
+		if test.raiseError {
+			continue
+		}
+		if xor.PopCount() != test.distance {
+			t.Errorf("Test %d: expected %d bits, got %d", testID, test.distance, xor.PopCount())
+		}
+		if back, _ := xor.Xor(test.b); !back.IsEqual(test.a) {
+			t.Errorf("Test %d: expected %s, got %s", testID, test.a.ToString(), back.ToString())
+		}
+	}
+	a := FuzzyHash{0x01}
+	a.Xor(FuzzyHash{0x01})
+	if a[0] != 0x01 {
+		t.Errorf("Xor modified the hash")
+	}
+}
+
+func TestFuzzyHashPopCount(t *testing.T) {
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	if count := fh.PopCount(); count != 256 {
+		t.Errorf("Expected 256, got %d", count)
+	}
+	if count := allZerosHashBin.PopCount(); count != 0 {
+		t.Errorf("Expected 0, got %d", count)
+	}
+	if count := (FuzzyHash{0x8000000000000001, 0x03}).PopCount(); count != 4 {
+		t.Errorf("Expected 4, got %d", count)
+	}
+}
+
 type HashFuzzyHashRshTest struct {
 	in  string
 	s   uint64
@@ -144,6 +352,110 @@ var hashFuzzyHashRshTests = []HashFuzzyHashRshTest{
 	{in: "11223344556677881122334455667788", s: 11, out: "00022446688aaccef1022446688aacce"},
 }
 
+type DistanceTest struct {
+	a, b       FuzzyHash
+	distance   int
+	raiseError bool
+}
+
+var distanceTests = []DistanceTest{
+	{a: FuzzyHash{}, b: FuzzyHash{}, distance: 0},
+	{a: FuzzyHash{0x0F}, b: FuzzyHash{0x0F}, distance: 0},
+	{a: FuzzyHash{0x0F}, b: FuzzyHash{0xF0}, distance: 8},
+	{a: FuzzyHash{0x01, 0x00}, b: FuzzyHash{0x00, 0xFFFFFFFFFFFFFFFF}, distance: 65},
+	{a: FuzzyHash{0x01, 0x00}, b: FuzzyHash{0x01}, raiseError: true},
+	{a: FuzzyHash{0x01}, b: FuzzyHash{}, raiseError: true},
+}
+
+func TestDistanceFunction(t *testing.T) {
+	for testID, test := range distanceTests {
+		distance, err := Distance(test.a, test.b)
+		if (err != nil) != test.raiseError {
+			t.Errorf("Test %d: expected error %v, got %v", testID, test.raiseError, err)
+		}
+		if !test.raiseError && distance != test.distance {
+			t.Errorf("Test %d: expected distance %d, got %d", testID, test.distance, distance)
+		}
+	}
+	a, b := FuzzyHash{0x01, 0x02}, FuzzyHash{0x03, 0x04}
+	if allocs := testing.AllocsPerRun(100, func() { Distance(a, b) }); allocs != 0 {
+		t.Errorf("Expected no allocations, got %v", allocs)
+	}
+}
+
+func TestRequiredDistance(t *testing.T) {
+	for testID, test := range distanceTests {
+		expected := test.distance
+		if test.raiseError {
+			expected = -1
+		}
+		if distance := RequiredDistance(test.a, test.b); distance != expected {
+			t.Errorf("Test %d: expected distance %d, got %d", testID, expected, distance)
+		}
+	}
+}
+
+func TestConfigWouldFind(t *testing.T) {
+	// 4 blocks of 16 bits
+	config := Config{HashSize: 64, MaxDistance: 3, UseMultiindex: true}
+	a := FuzzyHash{0x0123456789abcdef}
+	// One bit in every block: the distance is 4, no block matches
+	spread := FuzzyHash{a[0] ^ 0x0001000100010001}
+	// Eight bits in the block 0: blocks 1, 2 and 3 match
+	clustered := FuzzyHash{a[0] ^ 0x00ff}
+	if config.WouldFind(a, spread) || config.WouldFind(spread, a) {
+		t.Errorf("Expected a miss for the differences in all blocks, distance %d", RequiredDistance(a, spread))
+	}
+	if !config.WouldFind(a, clustered) || !config.WouldFind(clustered, a) {
+		t.Errorf("Expected a hit for the differences in one block, distance %d", RequiredDistance(a, clustered))
+	}
+	if !(Config{HashSize: 64, MaxDistance: 3}).WouldFind(a, spread) {
+		t.Errorf("Expected a hit without multi-index")
+	}
+	if config.WouldFind(a, FuzzyHash{0, 0}) {
+		t.Errorf("Expected a miss for a hash of wrong size")
+	}
+
+	// Pigeonhole: the multi-index finds every pair within MaxDistance
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 100; i++ {
+		hash := randomFuzzyHash(256, xs)
+		sibling := PerturbHash(hash, i%36, int64(i))
+		if !h.Config().WouldFind(hash, sibling) {
+			t.Fatalf("Pair %d: expected a hit, distance %d", i, RequiredDistance(hash, sibling))
+		}
+	}
+}
+
+func TestFuzzyHashAppendHex(t *testing.T) {
+	for testID, test := range hashFuzzyHashRshTests {
+		fh, _ := HashStringToFuzzyHash(test.in)
+		if hex := string(fh.AppendHex([]byte("0x"))); hex != "0x"+test.in {
+			t.Errorf("Test %d failed: expected 0x%s, got %s", testID, test.in, hex)
+		}
+	}
+	if hex := string(FuzzyHash{0x0f}.AppendHex(nil)); hex != "000000000000000f" {
+		t.Errorf("Expected leading zeros, got %s", hex)
+	}
+}
+
+func TestHammingDebugOutput(t *testing.T) {
+	var debugOutput strings.Builder
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, DebugOutput: &debugOutput})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h.Add(randomFuzzyHash(256, xs))
+	query := PerturbHash(h.hashes[0], 3, 0)
+	h.ShortestDistance(query)
+	expected := "Sample " + query.ToString() + " Candidate " + h.hashes[0].ToString() + " blockV="
+	lines := strings.Split(strings.TrimSuffix(debugOutput.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], expected) {
+		t.Errorf("Expected one line %s..., got %q", expected, debugOutput.String())
+	}
+}
+
 func TestFuzzyHashRsh(t *testing.T) {
 	for testID, test := range hashFuzzyHashRshTests {
 		fh, _ := HashStringToFuzzyHash(test.in)
@@ -154,6 +466,43 @@ func TestFuzzyHashRsh(t *testing.T) {
 	}
 }
 
+var hashFuzzyHashLshTests = []HashFuzzyHashRshTest{
+	{in: "11223344556677881122334455667788", s: 0, out: "11223344556677881122334455667788"},
+	{in: "11223344556677881122334455667788", s: 1, out: "22446688aaccef1022446688aaccef10"},
+	{in: "11223344556677881122334455667788", s: 2, out: "4488cd115599de204488cd115599de20"},
+	{in: "11223344556677881122334455667788", s: 3, out: "89119a22ab33bc4089119a22ab33bc40"},
+	{in: "11223344556677881122334455667788", s: 4, out: "12233445566778811223344556677880"},
+	{in: "11223344556677881122334455667788", s: 8, out: "22334455667788112233445566778800"},
+	{in: "11223344556677881122334455667788", s: 11, out: "119a22ab33bc4089119a22ab33bc4000"},
+	{in: "11223344556677881122334455667788", s: 63, out: "089119a22ab33bc40000000000000000"},
+	{in: "11223344556677881122334455667788", s: 64, out: "11223344556677880000000000000000"},
+	{in: "11223344556677881122334455667788", s: 65, out: "22446688aaccef100000000000000000"},
+	{in: "11223344556677881122334455667788", s: 100, out: "56677880000000000000000000000000"},
+	{in: "11223344556677881122334455667788", s: 127, out: "00000000000000000000000000000000"},
+	{in: "11223344556677881122334455667788", s: 128, out: "00000000000000000000000000000000"},
+	{in: "11223344556677881122334455667788", s: 200, out: "00000000000000000000000000000000"},
+}
+
+func TestFuzzyHashLsh(t *testing.T) {
+	for testID, test := range hashFuzzyHashLshTests {
+		fh, _ := HashStringToFuzzyHash(test.in)
+		fh.Lsh(test.s)
+		if fh.ToString() != test.out {
+			t.Errorf("Test %d failed: expected %s, got %s", testID, test.out, fh.ToString())
+		}
+	}
+	// Lsh restores the result of rsh, the upper bits are zeros
+	for testID, test := range hashFuzzyHashRshTests {
+		fh, _ := HashStringToFuzzyHash(test.out)
+		fh.Lsh(test.s)
+		fh.rsh(test.s)
+		if fh.ToString() != test.out {
+			t.Errorf("Test %d failed: expected %s, got %s", testID, test.out, fh.ToString())
+		}
+	}
+	FuzzyHash{}.Lsh(1)
+}
+
 type GenerateBitCombinationsTest struct {
 	value        uint64
 	combinations [][]int
@@ -184,6 +533,65 @@ func TestGenerateBitCombinations(t *testing.T) {
 	}
 }
 
+var fuzzyHashEqualPaddedTests = []struct {
+	fh       FuzzyHash
+	other    FuzzyHash
+	expected bool
+}{
+	{FuzzyHash{0x01, 0x02}, FuzzyHash{0x00, 0x00, 0x01, 0x02}, true},
+	{FuzzyHash{0x00, 0x00, 0x01, 0x02}, FuzzyHash{0x01, 0x02}, true},
+	{FuzzyHash{0x01, 0x02}, FuzzyHash{0x01, 0x02}, true},
+	{FuzzyHash{}, FuzzyHash{0x00, 0x00}, true},
+	{FuzzyHash{0x01, 0x02}, FuzzyHash{0x01, 0x02, 0x00, 0x00}, false},
+	{FuzzyHash{0x01, 0x02}, FuzzyHash{0x10, 0x00, 0x01, 0x02}, false},
+	{FuzzyHash{0x01, 0x02}, FuzzyHash{0x00, 0x00, 0x01, 0x03}, false},
+}
+
+func TestFuzzyHashIsZero(t *testing.T) {
+	if !allZerosHashBin.IsZero() || !(FuzzyHash{}).IsZero() {
+		t.Errorf("Expected zero hashes")
+	}
+	for _, fh := range []FuzzyHash{{0x00, 0x00, 0x00, 0x01}, {0x8000000000000000, 0x00}, {0xFF}} {
+		if fh.IsZero() {
+			t.Errorf("Hash %s is not zero", fh.ToString())
+		}
+	}
+}
+
+func TestFuzzyHashSplit(t *testing.T) {
+	fh := FuzzyHash{0x01, 0x02, 0x03, 0x04}
+	halves, err := fh.Split(2)
+	if err != nil || len(halves) != 2 || !halves[0].IsEqual(FuzzyHash{0x01, 0x02}) || !halves[1].IsEqual(FuzzyHash{0x03, 0x04}) {
+		t.Errorf("Expected two halves, got %v %v", halves, err)
+	}
+	words, err := fh.Split(4)
+	if err != nil || len(words) != 4 {
+		t.Fatalf("Expected 4 parts, got %v %v", words, err)
+	}
+	for i, word := range words {
+		if !word.IsEqual(FuzzyHash{fh[i]}) {
+			t.Errorf("Part %d: expected %x, got %v", i, fh[i], word)
+		}
+	}
+	words[0][0] = 0xFF
+	if fh[0] != 0x01 {
+		t.Errorf("The parts share the memory with the hash")
+	}
+	for _, parts := range []int{0, 3, 8, -1} {
+		if _, err := fh.Split(parts); err == nil {
+			t.Errorf("Expected an error for %d parts", parts)
+		}
+	}
+}
+
+func TestFuzzyHashEqualPadded(t *testing.T) {
+	for _, test := range fuzzyHashEqualPaddedTests {
+		if test.fh.EqualPadded(test.other) != test.expected {
+			t.Errorf("Hashes %v %v: expected %v", test.fh, test.other, test.expected)
+		}
+	}
+}
+
 func TestFuzzyHashToKey(t *testing.T) {
 	fh := FuzzyHash{0x3031323334353637, 0x3736353433323130}
 	expected := "\x37\x36\x35\x34\x33\x32\x31\x30\x30\x31\x32\x33\x34\x35\x36\x37"
@@ -205,6 +613,258 @@ func TestFuzzyHashToString(t *testing.T) {
 	}
 }
 
+func TestFuzzyHashBitAccessors(t *testing.T) {
+	fh := FuzzyHash{0x8000000000000000, 0x01}
+	for bit, expected := range map[int]int{0: 1, 1: 0, 63: 0, 64: 0, 127: 1} {
+		if v := fh.GetBit(bit); v != expected {
+			t.Errorf("Bit %d: expected %d, got %d", bit, expected, v)
+		}
+	}
+	fh.SetBit(0)
+	fh.SetBit(65)
+	if fh[0] != 0x8000000000000002 || fh[1] != 0x01 {
+		t.Errorf("Expected 80000000000000020000000000000001, got %s", fh.ToString())
+	}
+
+	xs := &XorShift1024Star{}
+	xs.Init()
+	base := randomFuzzyHash(256, xs)
+	for d := 0; d <= 256; d += 17 {
+		fh := base.Dup()
+		for _, bit := range rand.New(rand.NewSource(int64(d))).Perm(256)[:d] {
+			fh.FlipBit(bit)
+			if fh.GetBit(bit) == base.GetBit(bit) {
+				t.Fatalf("Bit %d is not flipped", bit)
+			}
+		}
+		if distance := distanceUint64s(base, fh); distance != d {
+			t.Errorf("Expected distance %d, got %d", d, distance)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for an out of range bit")
+		}
+	}()
+	fh.GetBit(128)
+}
+
+func TestFuzzyHashBitsAt(t *testing.T) {
+	fh := FuzzyHash{0x3031323334353637, 0x3736353433323130}
+	if v := fh.bitsAt(0, 8); v != 0x30 {
+		t.Errorf("Expected %x, got %x", 0x30, v)
+	}
+	if v := fh.bitsAt(60, 8); v != 0x73 {
+		t.Errorf("Expected %x, got %x", 0x73, v)
+	}
+	if v := fh.bitsAt(64, 64); v != fh[0] {
+		t.Errorf("Expected %x, got %x", fh[0], v)
+	}
+	if v := fh.bitsAt(124, 4); v != 0x3 {
+		t.Errorf("Expected %x, got %x", 0x3, v)
+	}
+}
+
+var fuzzyHashDistanceRangeTests = []struct {
+	startBit   int
+	endBit     int
+	distance   int
+	raiseError bool
+}{
+	{0, 256, 4 + 12 + 1 + 1, false},
+	{0, 64, 4, false},
+	{0, 4, 4, false}, // within one word
+	{4, 8, 0, false},
+	{64, 128, 12, false},
+	{60, 68, 4, false}, // spans two words
+	{124, 132, 4 + 1, false},
+	{128, 256, 2, false},
+	{10, 10, 0, false},
+	{-1, 10, 0, true},
+	{0, 257, 0, true},
+	{20, 10, 0, true},
+}
+
+func TestFuzzyHashDistanceRange(t *testing.T) {
+	fh := FuzzyHash{0x8000000000000000, 0x01, 0xF0000000000000FF, 0x0F}
+	other := FuzzyHash{0x00, 0x00, 0x00, 0x00}
+	for _, test := range fuzzyHashDistanceRangeTests {
+		distance, err := fh.DistanceRange(other, test.startBit, test.endBit)
+		if (err != nil) != test.raiseError {
+			t.Errorf("Range %d-%d: unexpected error %v", test.startBit, test.endBit, err)
+			continue
+		}
+		if distance != test.distance {
+			t.Errorf("Range %d-%d: expected %d, got %d", test.startBit, test.endBit, test.distance, distance)
+		}
+	}
+	if _, err := fh.DistanceRange(FuzzyHash{0x00}, 0, 64); err == nil {
+		t.Errorf("Expected an error for hashes of different sizes")
+	}
+}
+
+func TestHammingDecompose(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 100; i++ {
+		fh := randomFuzzyHash(256, xs)
+		blockValues := h.Decompose(fh)
+		if len(blockValues) != 36 {
+			t.Fatalf("Expected 36 blocks, got %d", len(blockValues))
+		}
+		// 35 blocks of 7 bits and the last block of 11 bits cover all 256 bits
+		reassembled := make(FuzzyHash, 4)
+		for b, blockValue := range blockValues {
+			for bit := 0; blockValue != 0; bit, blockValue = bit+1, blockValue>>1 {
+				offset := 7*b + bit
+				reassembled[3-offset/64] |= uint64(blockValue&1) << uint(offset%64)
+			}
+		}
+		if !reassembled.IsEqual(fh) {
+			t.Errorf("Expected %s, got %s", fh.ToString(), reassembled.ToString())
+		}
+	}
+}
+
+func TestHammingBlockOverlap(t *testing.T) {
+	h, err := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, BlockOverlap: 3})
+	if err != nil {
+		t.Fatalf("Failed to create a DB: %v", err)
+	}
+	// 7 bits blocks start every 4 bits, the last block is 8 bits
+	if h.blocks != 63 || h.blockSize != 7 || h.blockStep != 4 || h.lastBlockSize != 8 {
+		t.Errorf("Unexpected layout %+v", h.blockLayout)
+	}
+	fh := randomFuzzyHash(256, &XorShift1024Star{s: [16]uint64{1}})
+	blockValues := h.Decompose(fh)
+	for b, blockValue := range blockValues {
+		// 3 bits overlap with the next block
+		if b < len(blockValues)-1 && (blockValue>>4) != (blockValues[b+1]&0x7) {
+			t.Errorf("Block %d %x does not overlap the block %x", b, blockValue, blockValues[b+1])
+		}
+	}
+
+	// One bit in every one of the 36 disjoint blocks, or 36 bits
+	// The bits 4-10 are not modified
+	stored := allZerosHashBin.Dup()
+	query := allZerosHashBin.Dup()
+	for b := 0; b < 36; b++ {
+		bit := 7 * b
+		if b == 1 {
+			bit = 13
+		}
+		query[3-bit/64] |= uint64(1) << uint(bit%64)
+	}
+	disjoint, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	disjoint.Add(stored)
+	if sibling := disjoint.Distance(query); sibling.s != nil {
+		t.Errorf("Disjoint blocks: unexpected distance %d", sibling.distance)
+	}
+	h.Add(stored)
+	if sibling := h.Distance(query); sibling.distance != 36 || !sibling.s.IsEqual(stored) {
+		t.Errorf("Overlapping blocks: got distance %d, hash %s", sibling.distance, sibling.s.ToString())
+	}
+
+	if _, err := New(Config{HashSize: 256, MaxDistance: 35, BlockOverlap: 7}); err == nil {
+		t.Errorf("Expected an error for overlap equal to the block size")
+	}
+	if _, err := New(Config{HashSize: 512, MaxDistance: 35, BlockOverlap: 13}); err == nil {
+		t.Errorf("Expected an error for too many blocks")
+	}
+}
+
+func TestConfigProbeCount(t *testing.T) {
+	config := Config{HashSize: 256, MaxDistance: 35}
+	if probes := config.ProbeCount(); probes != 36 {
+		t.Errorf("Expected 36 probes, got %d", probes)
+	}
+	// 35 blocks of 7 bits and one block of 11 bits
+	expected := (35*float64(1<<20)/128 + float64(1<<20)/2048) / 36
+	if occupancy := config.AvgBucketOccupancy(1 << 20); occupancy < expected-0.001 || occupancy > expected+0.001 {
+		t.Errorf("Expected occupancy %f, got %f", expected, occupancy)
+	}
+	if occupancy := config.AvgBucketOccupancy(0); occupancy != 0 {
+		t.Errorf("Expected zero occupancy, got %f", occupancy)
+	}
+
+	config = Config{HashSize: 256, MaxDistance: 300}
+	if (config.ProbeCount() != 0) || (config.AvgBucketOccupancy(100) != 0) {
+		t.Errorf("Expected zeros for a bad config")
+	}
+}
+
+func TestHammingExplainMiss(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	target := allZerosHashBin.Dup()
+	h.Add(target)
+
+	// One bit in every block
+	query := allZerosHashBin.Dup()
+	for b := 0; b < 36; b++ {
+		query[3-(7*b)/64] |= uint64(1) << uint((7*b)%64)
+	}
+	explanation := h.ExplainMiss(query, target)
+	for _, expected := range []string{"distance 36,", "block 35 bits 245-255: 1 bits differ", "0 of 36 blocks match", "all blocks differ"} {
+		if !strings.Contains(explanation, expected) {
+			t.Errorf("Expected '%s' in\n%s", expected, explanation)
+		}
+	}
+
+	// Three bits in the block 2
+	explanation = h.ExplainMiss(FuzzyHash{0, 0, 0, 0x7 << 14}, target)
+	for _, expected := range []string{"distance 3,", "block 2 bits 14-20: 3 bits differ", "35 of 36 blocks match", "finds the target"} {
+		if !strings.Contains(explanation, expected) {
+			t.Errorf("Expected '%s' in\n%s", expected, explanation)
+		}
+	}
+
+	// Break the index: only the block 0 matches and the block 0 misses the target
+	query = FuzzyHash{0, 0, 0, 0}
+	for b := 1; b < 36; b++ {
+		query[3-(7*b)/64] |= uint64(1) << uint((7*b)%64)
+	}
+	delete(h.multiIndexTables[0], 0)
+	explanation = h.ExplainMiss(query, target)
+	for _, expected := range []string{"block 0 bits 0-6: match, the index misses the target", "1 of 36 blocks match", "the index is broken"} {
+		if !strings.Contains(explanation, expected) {
+			t.Errorf("Expected '%s' in\n%s", expected, explanation)
+		}
+	}
+	if sibling := h.Distance(query); sibling.s != nil {
+		t.Errorf("Expected a miss, got distance %d", sibling.distance)
+	}
+}
+
+func TestHammingPopcountMode(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	hardware, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	table, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, PopcountMode: PopcountTable})
+	for i := 0; i < 1000; i++ {
+		fh := randomFuzzyHash(256, xs)
+		hardware.Add(fh)
+		table.Add(fh)
+	}
+	for i := 0; i < 100; i++ {
+		d1 := randomFuzzyHash(256, xs)
+		d2 := hardware.hashes[i].Dup()
+		d2[0] &= xs.Uint64()
+		if hardware.hammingDistance(d1, d2) != table.hammingDistance(d1, d2) {
+			t.Errorf("Distance %s %s: %d != %d", d1.ToString(), d2.ToString(),
+				hardware.hammingDistance(d1, d2), table.hammingDistance(d1, d2))
+		}
+		if sibling := table.ShortestDistance(d2); !sibling.isEqual(hardware.ShortestDistance(d2)) {
+			t.Errorf("Sibling of %s: distance %d", d2.ToString(), sibling.distance)
+		}
+	}
+	allFs, _ := HashStringToFuzzyHash(allFsHash)
+	if d := table.hammingDistance(allFs, allZerosHashBin); d != 256 {
+		t.Errorf("Expected 256, got %d", d)
+	}
+}
+
 type HammingAddTest struct {
 	hashSize    int
 	maxDistance int
@@ -348,52 +1008,1588 @@ var hammingDistanceTests = []HammingDistanceTest{
 	},
 }
 
-func TestHammingDistance(t *testing.T) {
-	for testID, test := range hammingDistanceTests {
-		h, err := New(Config{HashSize: test.hashSize, MaxDistance: test.maxDistance, UseMultiindex: true})
-		if err != nil {
-			t.Errorf("Test %d failed: %v", testID, err)
+func TestHammingDistance(t *testing.T) {
+	for testID, test := range hammingDistanceTests {
+		h, err := New(Config{HashSize: test.hashSize, MaxDistance: test.maxDistance, UseMultiindex: true})
+		if err != nil {
+			t.Errorf("Test %d failed: %v", testID, err)
+		}
+		for _, hash := range test.hashes {
+			fh, _ := HashStringToFuzzyHash(hash)
+			if !h.Add(fh) {
+				t.Errorf("Test %d failed", testID)
+			}
+			if !h.Contains(fh) {
+				t.Errorf("Test %d failed", testID)
+			}
+		}
+		fh, _ := HashStringToFuzzyHash(test.sampleHash)
+		bestSibling := h.ShortestDistance(fh)
+		if bestSibling.distance != test.bestSibling.distance {
+			t.Errorf("Test %d failed: expected %d got %d", testID, test.bestSibling.distance, bestSibling.distance)
+		}
+		if !bestSibling.s.IsEqual(test.bestSibling.s) {
+			t.Errorf("Test %d failed: expected %s got %s", testID, test.bestSibling.s.ToString(), bestSibling.s.ToString())
+		}
+		siblingBruteForce := h.shortestDistanceBruteForce(fh)
+		if !bestSibling.isEqual(siblingBruteForce) {
+			t.Errorf("Test %d failed: expected %s got %s", testID, bestSibling.s.ToString(), siblingBruteForce.s.ToString())
+		}
+	}
+}
+
+func TestHammingBadHash(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		h.Add(allZerosHashBin.Dup())
+		for _, fh := range []FuzzyHash{nil, FuzzyHash{}, FuzzyHash{0x00, 0x00}, FuzzyHash{0x00, 0x00, 0x00, 0x00, 0x00}} {
+			if h.Add(fh) {
+				t.Errorf("Added a hash of %d words", len(fh))
+			}
+			if h.Contains(fh) {
+				t.Errorf("Found a hash of %d words", len(fh))
+			}
+			if sibling := h.ShortestDistance(fh); sibling.s != nil {
+				t.Errorf("Found a sibling %s for a hash of %d words", sibling.s.ToString(), len(fh))
+			}
+			if h.RemoveBulk([]FuzzyHash{fh}) {
+				t.Errorf("Removed a hash of %d words", len(fh))
+			}
+		}
+		if h.Count() != 1 {
+			t.Errorf("Expected 1 hash, got %d", h.Count())
+		}
+	}
+	if v := FuzzyHash(nil).and(0xFF); v != 0 {
+		t.Errorf("Expected 0, got %x", v)
+	}
+}
+
+func TestFuzzyHashMaskPadding(t *testing.T) {
+	fh := FuzzyHash{0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF}
+	masked := fh.maskPadding(100)
+	if !masked.IsEqual(FuzzyHash{0x0000000FFFFFFFFF, 0xFFFFFFFFFFFFFFFF}) {
+		t.Errorf("Got %s", masked.ToString())
+	}
+	if fh[0] != 0xFFFFFFFFFFFFFFFF {
+		t.Errorf("Modified the original hash %s", fh.ToString())
+	}
+	if masked = fh.maskPadding(128); !masked.IsEqual(fh) {
+		t.Errorf("Got %s", masked.ToString())
+	}
+}
+
+func TestHammingPadding(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		h, err := New(Config{HashSize: 100, MaxDistance: 9, UseMultiindex: useMultiindex})
+		if err != nil {
+			t.Fatalf("Failed to create a 100 bits DB: %v", err)
+		}
+		clean := FuzzyHash{0x0000000123456789, 0xABCDEF0123456789}
+		dirty := FuzzyHash{0xF000000123456789, 0xABCDEF0123456789}
+		if !h.Add(clean) {
+			t.Errorf("Failed to add %s", clean.ToString())
+		}
+		if h.Add(dirty) {
+			t.Errorf("Added %s which differs only in the padding bits", dirty.ToString())
+		}
+		if !h.Contains(dirty) {
+			t.Errorf("Failed to find %s", dirty.ToString())
+		}
+		sibling := h.Distance(FuzzyHash{0xF000000123456789, 0xABCDEF0123456788})
+		if sibling.distance != 1 || !sibling.s.IsEqual(clean) {
+			t.Errorf("Expected distance 1, got %d, %s", sibling.distance, sibling.s.ToString())
+		}
+		h.RemoveBulk([]FuzzyHash{dirty})
+		if h.Contains(clean) {
+			t.Errorf("Failed to remove %s", clean.ToString())
+		}
+	}
+	if _, err := New(Config{HashSize: 0, MaxDistance: 9}); err == nil {
+		t.Errorf("Expected an error for zero hash size")
+	}
+}
+
+func TestHammingDup(t *testing.T) {
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	h.Add(fh)
+	sibling := h.ShortestDistance(fh)
+	if sibling.distance != 0 || !sibling.s.IsEqual(fh) {
+		t.Errorf("Failed to find sibling: got distance %d, hash %s %v", sibling.distance, sibling.s.ToString(), h.multiIndexTables)
+	}
+	h = h.Dup()
+	sibling = h.ShortestDistance(fh)
+	if sibling.distance != 0 || !sibling.s.IsEqual(fh) {
+		t.Errorf("Failed to find sibling: got distance %d, hash %s", sibling.distance, sibling.s.ToString())
+	}
+	siblingBruteForce := h.shortestDistanceBruteForce(fh)
+	if !sibling.isEqual(siblingBruteForce) {
+		t.Errorf("Failed to brute force: expected %s got %s", sibling.s.ToString(), siblingBruteForce.s.ToString())
+	}
+}
+
+func TestHammingDupVerify(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		clusteredDataSet(h, 10, 100, 10, xs)
+		for i := 0; i < 1000; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		h.Add(h.hashes[7].Dup())
+		if err := h.Verify(); err != nil {
+			t.Fatalf("Multiindex %v: original: %v", useMultiindex, err)
+		}
+		clone := h.Dup()
+		if err := clone.Verify(); err != nil {
+			t.Fatalf("Multiindex %v: clone: %v", useMultiindex, err)
+		}
+		for b := range h.multiIndexTables {
+			if (h.multiIndexTables[b] == nil) != (clone.multiIndexTables[b] == nil) {
+				t.Errorf("Multiindex %v: table %d: expected nil %v", useMultiindex, b, h.multiIndexTables[b] == nil)
+			}
+		}
+		if clone.Occurrences(h.hashes[7]) != 2 {
+			t.Errorf("Multiindex %v: expected 2 occurrences, got %d", useMultiindex, clone.Occurrences(h.hashes[7]))
+		}
+
+		for i := 0; i < 100; i++ {
+			query := h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+			query[0] ^= xs.Uint64() & xs.Uint64()
+			if i%4 == 0 {
+				query = randomFuzzyHash(256, xs)
+			}
+			if sibling, expected := clone.ShortestDistance(query), h.ShortestDistance(query); !sibling.isEqual(expected) {
+				t.Fatalf("Multiindex %v: expected %v, got %v", useMultiindex, expected, sibling)
+			}
+			siblings, expected := clone.KNearest(query, 5), h.KNearest(query, 5)
+			if len(siblings) != len(expected) {
+				t.Fatalf("Multiindex %v: expected %d siblings, got %d", useMultiindex, len(expected), len(siblings))
+			}
+			for j := range siblings {
+				if siblings[j].distance != expected[j].distance {
+					t.Fatalf("Multiindex %v: expected %v, got %v", useMultiindex, expected, siblings)
+				}
+			}
+		}
+	}
+
+	// Break the index
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	h.Add(fh)
+	h.multiIndexTables[0][0x7F] = append(h.multiIndexTables[0][0x7F], 1)
+	if err := h.Verify(); err == nil {
+		t.Errorf("Expected an error for an index entry out of range")
+	}
+	delete(h.multiIndexTables[0], 0x7F)
+	if err := h.Verify(); err == nil {
+		t.Errorf("Expected an error for a missing index entry")
+	}
+}
+
+// keyAliases returns true if the key points to the memory of the hash
+func keyAliases(key string, hash FuzzyHash) bool {
+	stringHeader := (*reflect.StringHeader)(unsafe.Pointer(&key))
+	return stringHeader.Data == uintptr(unsafe.Pointer(&hash[0]))
+}
+
+func TestHammingRehashSafe(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 100; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.Add(h.hashes[3].Dup())
+	aliases := func() int {
+		count := 0
+		for key, hashIndex := range h.hashesLookup {
+			if keyAliases(key, h.hashes[hashIndex]) {
+				count++
+			}
+		}
+		return count
+	}
+	if count := aliases(); count != len(h.hashes) {
+		t.Errorf("Expected %d aliasing keys, got %d", len(h.hashes), count)
+	}
+
+	h.RehashSafe()
+	fh := randomFuzzyHash(256, xs)
+	h.Add(fh)
+	if count := aliases(); count != 0 {
+		t.Errorf("Expected no aliasing keys, got %d", count)
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatalf("Index is broken: %v", err)
+	}
+	for _, hash := range h.hashes {
+		if !h.Contains(hash.Dup()) {
+			t.Errorf("Hash %s is missing", hash.ToString())
+		}
+		query := hash.Dup()
+		query[0] ^= 0x11
+		if sibling := h.ShortestDistance(query); sibling.distance != 2 || !sibling.s.IsEqual(hash) {
+			t.Errorf("Hash %s: got distance %d, hash %s", hash.ToString(), sibling.distance, sibling.s.ToString())
+		}
+	}
+	if occurrences := h.Occurrences(h.hashes[3]); occurrences != 2 {
+		t.Errorf("Expected 2 occurrences, got %d", occurrences)
+	}
+}
+
+func TestHammingExpectedCount(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, err := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ExpectedCount: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create H: %v", err)
+	}
+	if cap(h.hashes) != 1000 {
+		t.Errorf("Expected capacity 1000, got %d", cap(h.hashes))
+	}
+	for i := 0; i < 2000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	if err := h.Verify(); err != nil {
+		t.Errorf("Index is broken: %v", err)
+	}
+	if _, err := New(Config{HashSize: 256, MaxDistance: 35, ExpectedCount: -1}); err == nil {
+		t.Errorf("Expected an error for negative ExpectedCount")
+	}
+
+	// 4 blocks of 64 bits
+	h, _ = New(Config{HashSize: 256, MaxDistance: 3, UseMultiindex: true, ExpectedCount: 1000})
+	for i := 0; i < 10; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	if err := h.Verify(); err != nil {
+		t.Errorf("Index of large blocks is broken: %v", err)
+	}
+}
+
+// Removal keeps a tombstone, the survivors keep their indexes
+func TestHammingRemoveMiddle(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		var hashes []FuzzyHash
+		for i := 0; i < 101; i++ {
+			hashes = append(hashes, randomFuzzyHash(256, xs))
+		}
+		h.AddBulk(hashes)
+		if !h.RemoveBulk([]FuzzyHash{hashes[50]}) {
+			t.Fatalf("Multiindex %v: failed to remove", useMultiindex)
+		}
+		if h.Contains(hashes[50]) || h.Count() != 100 {
+			t.Errorf("Multiindex %v: expected 100 hashes without the removed one, got %d", useMultiindex, h.Count())
+		}
+		for i, fh := range hashes {
+			if i == 50 {
+				continue
+			}
+			if !h.Contains(fh) || (h.hashesLookup[fh.toKey()] != uint32(i)) || !h.hashes[i].IsEqual(fh) {
+				t.Fatalf("Multiindex %v: hash %d moved or lost", useMultiindex, i)
+			}
+			if sibling := h.ShortestDistance(PerturbHash(fh, 5, int64(i))); (sibling.distance != 5) || !sibling.s.IsEqual(fh) {
+				t.Errorf("Multiindex %v: hash %d: got distance %d, hash %s", useMultiindex, i, sibling.distance, sibling.s.ToString())
+			}
+		}
+	}
+}
+
+func TestHammingRemoveMultiindex(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(h, 10, 100, 10, xs)
+	notFound := h.Stats().RemoveIndexNotFound3
+	removed := []uint32{0, 17, 500, uint32(len(h.hashes) - 1)}
+	for _, hashIndex := range removed {
+		if !h.RemoveBulk([]FuzzyHash{h.hashes[hashIndex]}) {
+			t.Fatalf("Failed to remove hash %d", hashIndex)
+		}
+	}
+	if h.Stats().RemoveIndexNotFound3 != notFound {
+		t.Errorf("Unexpected misses in the index tables: %d", h.Stats().RemoveIndexNotFound3-notFound)
+	}
+	for b, indexTable := range h.multiIndexTables {
+		for blockValue, hashes := range indexTable {
+			for _, hashIndex := range hashes {
+				for _, removedIndex := range removed {
+					if hashIndex == removedIndex {
+						t.Fatalf("Block %d value %x: removed hash %d is in the index", b, blockValue, hashIndex)
+					}
+				}
+			}
+		}
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatalf("Index is broken: %v", err)
+	}
+
+	// A genuine miss
+	h.removeMultiindex(0, h.blockValue(h.hashes[1], 0), 0, 0)
+	if h.Stats().RemoveIndexNotFound3 != notFound+1 {
+		t.Errorf("Expected one miss, got %d", h.Stats().RemoveIndexNotFound3-notFound)
+	}
+}
+
+func TestHammingCompactHashes(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		var live, removed []FuzzyHash
+		for i := 0; i < 300; i++ {
+			fh := randomFuzzyHash(256, xs)
+			h.Add(fh)
+			if i%3 == 0 {
+				removed = append(removed, fh)
+			} else {
+				live = append(live, fh)
+			}
+		}
+		h.RemoveBulk(removed)
+		checkQueries := func() {
+			if h.Count() != len(live) {
+				t.Fatalf("Multiindex %v: expected %d hashes, got %d", useMultiindex, len(live), h.Count())
+			}
+			for _, fh := range removed {
+				if sibling := h.ShortestDistance(PerturbHash(fh, 3, 1)); sibling.s.IsEqual(fh) {
+					t.Fatalf("Multiindex %v: found removed hash %s", useMultiindex, fh.ToString())
+				}
+			}
+			for i, fh := range live {
+				query := PerturbHash(fh, 3, int64(i))
+				if sibling := h.ShortestDistance(query); (sibling.distance != 3) || !sibling.s.IsEqual(fh) {
+					t.Fatalf("Multiindex %v: got distance %d, hash %s", useMultiindex, sibling.distance, sibling.s.ToString())
+				}
+			}
+		}
+		checkQueries()
+
+		if count := h.CompactHashes(); count != len(live) || len(h.hashes) != len(live) {
+			t.Errorf("Multiindex %v: expected %d hashes, got %d and %d", useMultiindex, len(live), count, len(h.hashes))
+		}
+		if err := h.Verify(); err != nil {
+			t.Fatalf("Multiindex %v: index is broken: %v", useMultiindex, err)
+		}
+		checkQueries()
+		for i, fh := range live {
+			if !h.hashes[i].IsEqual(fh) {
+				t.Errorf("Multiindex %v: hash %d: expected %s, got %s", useMultiindex, i, fh.ToString(), h.hashes[i].ToString())
+			}
+		}
+	}
+}
+
+func TestHammingMaxBlocks(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, err := New(Config{HashSize: 256, MaxDistance: maxBlocks - 1, UseMultiindex: true})
+	if err != nil {
+		t.Fatalf("Failed to create %d blocks: %v", maxBlocks, err)
+	}
+	if len(h.multiIndexTables) != maxBlocks {
+		t.Fatalf("Expected %d index tables, got %d", maxBlocks, len(h.multiIndexTables))
+	}
+	for i := 0; i < 200; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	if err := h.Verify(); err != nil {
+		t.Fatalf("Index is broken: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		query := PerturbHash(h.hashes[i], 3*i, int64(i))
+		if sibling, expected := h.ShortestDistance(query), h.shortestDistanceBruteForce(query); sibling.distance != expected.distance {
+			t.Errorf("Query %d: expected distance %d, got %d", i, expected.distance, sibling.distance)
+		}
+	}
+	h.RebuildIndex()
+	h.RebuildBlock(maxBlocks - 1)
+	if err := h.Verify(); err != nil {
+		t.Fatalf("Rebuilt index is broken: %v", err)
+	}
+	h.RemoveAll()
+	if len(h.multiIndexTables) != maxBlocks {
+		t.Errorf("Expected %d index tables after RemoveAll, got %d", maxBlocks, len(h.multiIndexTables))
+	}
+	if _, err := New(Config{HashSize: 512, MaxDistance: maxBlocks, UseMultiindex: true}); err == nil {
+		t.Errorf("Expected an error for %d blocks", maxBlocks+1)
+	}
+}
+
+// The multi-index finds a sibling which differs only in the large last block
+func TestHammingLastBlockDifference(t *testing.T) {
+	configs := []Config{
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true}, // 7 bits blocks, 11 bits last block
+		{HashSize: 256, MaxDistance: 20, UseMultiindex: true},
+		{HashSize: 200, MaxDistance: 20, UseMultiindex: true},
+	}
+	for _, config := range configs {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(config)
+		for i := 0; i < 1000; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		if h.lastBlockSize <= h.blockSize {
+			t.Fatalf("%+v: expected a large last block, got %d bits", config, h.lastBlockSize)
+		}
+		for distance := 1; distance <= h.lastBlockSize; distance++ {
+			query := PerturbBlock(h, h.hashes[distance], h.blocks-1, distance, int64(distance))
+			sibling, expected := h.ShortestDistance(query), h.shortestDistanceBruteForce(query)
+			if !sibling.isEqual(expected) || sibling.distance != distance {
+				t.Errorf("%+v: distance %d: expected %v, got %v", config, distance, expected, sibling)
+			}
+		}
+	}
+}
+
+// skewedDataSet adds hashes with the 64 least significant bits cleared
+// All hashes share the first 9 blocks
+func skewedDataSet(h *H, count int, xs *XorShift1024Star) {
+	var hashes []FuzzyHash
+	for i := 0; i < count; i++ {
+		fh := randomFuzzyHash(256, xs)
+		fh[3] = 0
+		hashes = append(hashes, fh)
+	}
+	h.AddBulk(hashes)
+}
+
+// candidatesBeforeBest returns the number of candidates the search checks
+// before it finds the closest sibling
+func candidatesBeforeBest(h *H, query FuzzyHash) int {
+	best, candidates, beforeBest := h.config.HashSize+1, 0, 0
+	h.visitCandidates(query, func(candidateIndex uint32, candidateHash FuzzyHash) bool {
+		candidates++
+		if distance := h.hammingDistance(query, candidateHash); distance < best {
+			best, beforeBest = distance, candidates
+		}
+		return true
+	})
+	return beforeBest
+}
+
+func TestHammingReorderBlocks(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	skewedDataSet(h, 2000, xs)
+	reordered, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ReorderBlocks: true})
+	reordered.AddBulk(h.hashes)
+	if reordered.blockOrder != nil {
+		t.Fatalf("AddBulk() reordered the blocks: %v", reordered.blockOrder)
+	}
+	reordered.ReorderBlocks()
+	for _, b := range reordered.blockOrder[:reordered.blocks-9] {
+		if b < 9 {
+			t.Fatalf("Constant block %d is probed early: %v", b, reordered.blockOrder)
+		}
+	}
+
+	natural, sorted := 0, 0
+	for i := 0; i < 100; i++ {
+		query := PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], 10, int64(i))
+		if sibling, expected := reordered.ShortestDistance(query), h.ShortestDistance(query); !sibling.isEqual(expected) {
+			t.Fatalf("Query %d: expected %v, got %v", i, expected, sibling)
+		}
+		natural += candidatesBeforeBest(h, query)
+		sorted += candidatesBeforeBest(reordered, query)
+	}
+	if sorted*10 > natural {
+		t.Errorf("Expected fewer candidates before the best, got %d and %d", sorted, natural)
+	}
+	if err := reordered.Dup().Verify(); err != nil || reordered.Dup().blockOrder == nil {
+		t.Errorf("Clone lost the order: %v", err)
+	}
+}
+
+func TestHammingRebuildBlock(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(h, 10, 100, 10, xs)
+	var queries []FuzzyHash
+	var expected []Sibling
+	for i := 0; i < 100; i++ {
+		query := PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], 20, int64(i))
+		queries = append(queries, query)
+		expected = append(expected, h.ShortestDistance(query))
+	}
+
+	h.multiIndexTables[3] = make(indexTable)
+	h.multiIndexTables[5][h.blockValue(h.hashes[0], 5)] = []uint32{7, 3}
+	if h.Verify() == nil {
+		t.Fatalf("Expected a broken index")
+	}
+	h.RebuildBlock(3)
+	h.RebuildBlock(5)
+	h.RebuildBlock(-1)
+	h.RebuildBlock(h.blocks)
+	if err := h.Verify(); err != nil {
+		t.Fatalf("Index is not repaired: %v", err)
+	}
+	for i, query := range queries {
+		if sibling := h.ShortestDistance(query); !sibling.isEqual(expected[i]) {
+			t.Errorf("Query %d: expected %v, got %v", i, expected[i], sibling)
+		}
+	}
+}
+
+func TestHammingRemoveFunc(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		clusteredDataSet(h, 10, 100, 10, xs)
+		hashes := append([]FuzzyHash{}, h.hashes...)
+		highBit := func(hash FuzzyHash) bool { return hash[0]&(1<<63) != 0 }
+		expected := 0
+		for _, hash := range hashes {
+			if highBit(hash) {
+				expected++
+			}
+		}
+		if removed := h.RemoveFunc(highBit); removed != expected || expected == 0 {
+			t.Fatalf("Multiindex %v: expected %d removed, got %d", useMultiindex, expected, removed)
+		}
+		if h.Count() != len(hashes)-expected {
+			t.Errorf("Multiindex %v: expected %d hashes, got %d", useMultiindex, len(hashes)-expected, h.Count())
+		}
+		if err := h.Verify(); err != nil {
+			t.Fatalf("Multiindex %v: %v", useMultiindex, err)
+		}
+		for _, hash := range hashes {
+			if h.Contains(hash) == highBit(hash) {
+				t.Errorf("Multiindex %v: hash %s: expected contains %v", useMultiindex, hash.ToString(), !highBit(hash))
+			}
+		}
+		for i := 0; i < 100; i++ {
+			query := PerturbHash(hashes[xs.Uint64()%uint64(len(hashes))], 10, int64(i))
+			sibling, expected := h.ShortestDistance(query), h.shortestDistanceBruteForce(query)
+			if expected.distance > 35 { // the cluster is gone
+				continue
+			}
+			if sibling.distance != expected.distance || highBit(sibling.s) {
+				t.Errorf("Multiindex %v: expected distance %d, got %v", useMultiindex, expected.distance, sibling)
+			}
+		}
+		if removed := h.RemoveFunc(highBit); removed != 0 {
+			t.Errorf("Multiindex %v: expected nothing to remove, got %d", useMultiindex, removed)
+		}
+	}
+}
+
+func TestHammingRebuildIndex(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	var hashes []FuzzyHash
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		hashes = append(hashes, fh)
+	}
+	h.AddBulk(hashes)
+
+	// Break the lookup map: a missing entry, a stale index, an unknown hash
+	delete(h.hashesLookup, hashes[1].toKey())
+	h.hashesLookup[hashes[2].toKey()] = 5
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	h.hashesLookup[fh.toKey()] = 0
+	h.multiIndexTables = make([]indexTable, h.blocks)
+
+	if err := h.RebuildIndex(); err != nil {
+		t.Fatalf("Failed to rebuild the index: %v", err)
+	}
+	if len(h.hashesLookup) != len(hashes) {
+		t.Errorf("Expected %d entries in the lookup map, got %d", len(hashes), len(h.hashesLookup))
+	}
+	for hashIndex, hash := range hashes {
+		if h.hashesLookup[hash.toKey()] != uint32(hashIndex) {
+			t.Errorf("Hash %s: expected index %d, got %d", hash.ToString(), hashIndex, h.hashesLookup[hash.toKey()])
+		}
+	}
+	if h.Contains(fh) {
+		t.Errorf("Unexpected hash %s after rebuild", fh.ToString())
+	}
+	sample, _ := HashStringToFuzzyHash(hammingDistanceTests[2].sampleHash)
+	sibling := h.Distance(sample)
+	if !sibling.isEqual(h.shortestDistanceBruteForce(sample)) {
+		t.Errorf("Multi-index is not rebuilt: got distance %d, hash %s", sibling.distance, sibling.s.ToString())
+	}
+
+	// A duplicate in the array of hashes can not be repaired
+	h.hashes = append(h.hashes, hashes[3])
+	if err := h.RebuildIndex(); err == nil {
+		t.Errorf("Expected an error for a duplicate hash")
+	}
+	if len(h.hashesLookup) != len(hashes) {
+		t.Errorf("Failed rebuild modified the lookup map")
+	}
+
+	h.hashes = append(h.hashes[:len(hashes)], FuzzyHash{0x00})
+	if err := h.RebuildIndex(); err == nil {
+		t.Errorf("Expected an error for a short hash")
+	}
+}
+
+type HammingBlockMatchesTest struct {
+	sampleHash   string
+	distance     int
+	blockMatches int
+}
+
+var hammingBlockMatchesTests = []HammingBlockMatchesTest{
+	// 36 blocks, 7 bits each
+	{sampleHash: allZerosHash, distance: 0, blockMatches: 36},
+	{sampleHash: "0000000000000000000000000000000000000000000000000000000000000003", distance: 2, blockMatches: 35},
+	{sampleHash: "0000000000000000000000000000000000000000000000000000000000004081", distance: 3, blockMatches: 33},
+	{sampleHash: "0FFF000000000000000000000000000000000000000000000000000000000000", distance: 12, blockMatches: 34},
+}
+
+func TestHammingShortestDistanceWithBlockMatches(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	fh, _ := HashStringToFuzzyHash(allZerosHash)
+	h.Add(fh)
+	fh, _ = HashStringToFuzzyHash(allFsHash)
+	h.Add(fh)
+	for testID, test := range hammingBlockMatchesTests {
+		fh, _ := HashStringToFuzzyHash(test.sampleHash)
+		sibling, blockMatches := h.ShortestDistanceWithBlockMatches(fh)
+		if sibling.distance != test.distance {
+			t.Errorf("Test %d failed: expected distance %d, got %d", testID, test.distance, sibling.distance)
+		}
+		if blockMatches != test.blockMatches {
+			t.Errorf("Test %d failed: expected %d block matches, got %d", testID, test.blockMatches, blockMatches)
+		}
+	}
+
+	h, _ = New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	if _, blockMatches := h.ShortestDistanceWithBlockMatches(fh); blockMatches != 0 {
+		t.Errorf("Expected no block matches in an empty DB, got %d", blockMatches)
+	}
+}
+
+func TestHammingScoreCandidate(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for testID, test := range hammingBlockMatchesTests {
+		fh, _ := HashStringToFuzzyHash(test.sampleHash)
+		distance, blockMatches := h.ScoreCandidate(fh, allZerosHashBin)
+		if distance != test.distance || blockMatches != test.blockMatches {
+			t.Errorf("Test %d failed: expected %d/%d, got %d/%d", testID, test.distance, test.blockMatches, distance, blockMatches)
+		}
+	}
+
+	// Overlapping blocks and the padding bits
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for _, config := range []Config{{HashSize: 256, MaxDistance: 15, BlockOverlap: 4}, {HashSize: 200, MaxDistance: 20}} {
+		h, _ := New(config)
+		for i := 0; i < 100; i++ {
+			query, candidate := randomFuzzyHash(256, xs), randomFuzzyHash(256, xs)
+			if i%2 == 0 {
+				candidate = PerturbHash(query, i%30, int64(i))
+			}
+			distance, blockMatches := h.ScoreCandidate(query, candidate)
+			query, candidate = query.maskPadding(config.HashSize), candidate.maskPadding(config.HashSize)
+			if expected := h.hammingDistance(query, candidate); distance != expected {
+				t.Errorf("%+v: expected distance %d, got %d", config, expected, distance)
+			}
+			if expected := h.matchingBlocks(query, candidate); blockMatches != expected {
+				t.Errorf("%+v: expected %d block matches, got %d", config, expected, blockMatches)
+			}
+		}
+	}
+	if distance, blockMatches := h.ScoreCandidate(FuzzyHash{0x01}, allZerosHashBin); distance != 256 || blockMatches != 0 {
+		t.Errorf("Expected 256/0 for a bad hash, got %d/%d", distance, blockMatches)
+	}
+}
+
+func TestHammingShortestDistanceScored(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for _, hash := range hammingDistanceTests[0].hashes {
+			fh, _ := HashStringToFuzzyHash(hash)
+			h.Add(fh)
+		}
+		fh, _ := HashStringToFuzzyHash("0000000000000000000000000000000000000000000000000000000000000003")
+		sibling := h.ShortestDistanceScored(fh, func(candidate FuzzyHash, distance int) float64 {
+			return float64(distance)
+		})
+		if sibling.distance != 1 || !sibling.s.IsEqual(FuzzyHash{0x00, 0x00, 0x00, 0x01}) {
+			t.Errorf("Multiindex %v: got distance %d, hash %s", useMultiindex, sibling.distance, sibling.s.ToString())
+		}
+
+		// Penalize the closest hashes
+		penalties := map[string]float64{
+			"0000000000000000000000000000000000000000000000000000000000000001": 10,
+			"0000000000000000000000000000000000000000000000000000000000000011": 10,
+		}
+		sibling = h.ShortestDistanceScored(fh, func(candidate FuzzyHash, distance int) float64 {
+			return float64(distance) + penalties[candidate.ToString()]
+		})
+		if sibling.distance != 2 || !sibling.s.IsEqual(allZerosHashBin) {
+			t.Errorf("Multiindex %v: got distance %d, hash %s", useMultiindex, sibling.distance, sibling.s.ToString())
+		}
+	}
+}
+
+func TestHammingShortestDistanceMulti(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for _, hash := range hammingDistanceTests[0].hashes[4:] {
+			fh, _ := HashStringToFuzzyHash(hash)
+			h.Add(fh)
+		}
+		// 0x1111 is at distance 2, 0x11111 is at distance 1
+		first := FuzzyHash{0x00, 0x00, 0x00, 0x11}
+		second := FuzzyHash{0x00, 0x00, 0x00, 0x11110}
+		sibling := h.ShortestDistanceMulti([]FuzzyHash{first, second})
+		if sibling.distance != 1 || !sibling.s.IsEqual(FuzzyHash{0x00, 0x00, 0x00, 0x11111}) {
+			t.Errorf("Multiindex %v: got distance %d, hash %s", useMultiindex, sibling.distance, sibling.s.ToString())
+		}
+		if sibling = h.ShortestDistanceMulti([]FuzzyHash{first}); sibling.distance != 2 {
+			t.Errorf("Multiindex %v: expected distance 2, got %d", useMultiindex, sibling.distance)
+		}
+		if sibling = h.ShortestDistanceMulti(nil); sibling.s != nil || sibling.distance != 256 {
+			t.Errorf("Multiindex %v: expected no sibling, got %v", useMultiindex, sibling)
+		}
+	}
+}
+
+func TestHammingShortestDistanceStream(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		clusteredDataSet(h, 5, 100, 12, xs)
+		for i := 0; i < 100; i++ {
+			query := h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+			query[0] ^= xs.Uint64() & xs.Uint64()
+			betterCandidates := h.Stats().DistanceBetterCandidate
+			var siblings []Sibling
+			h.ShortestDistanceStream(query, func(sibling Sibling) {
+				siblings = append(siblings, sibling)
+			})
+			if len(siblings) == 0 {
+				t.Fatalf("Multiindex %v: no siblings for %s", useMultiindex, query.ToString())
+			}
+			// The ties add calls and do not add better candidates
+			if calls := h.Stats().DistanceBetterCandidate - betterCandidates; calls > uint64(len(siblings)) {
+				t.Errorf("Multiindex %v: expected at least %d calls, got %d calls", useMultiindex, calls, len(siblings))
+			}
+			for j := 1; j < len(siblings); j++ {
+				if siblings[j].distance > siblings[j-1].distance {
+					t.Fatalf("Multiindex %v: distance %d after %d", useMultiindex, siblings[j].distance, siblings[j-1].distance)
+				}
+			}
+			last, expected := siblings[len(siblings)-1], h.ShortestDistance(query)
+			if (last.distance != expected.distance) || !last.s.IsEqual(expected.s) {
+				t.Errorf("Multiindex %v: expected %v, got %v", useMultiindex, expected, last)
+			}
+		}
+	}
+
+	// Two siblings at distance 1, the smaller hash wins the tie
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35})
+	h.Add(FuzzyHash{0, 0, 0, 2})
+	h.Add(FuzzyHash{0, 0, 0, 1})
+	var last Sibling
+	h.ShortestDistanceStream(FuzzyHash{0, 0, 0, 0}, func(sibling Sibling) {
+		last = sibling
+	})
+	if expected := h.ShortestDistance(FuzzyHash{0, 0, 0, 0}); (last.distance != 1) || !last.s.IsEqual(expected.s) {
+		t.Errorf("Expected %v, got %v", expected, last)
+	}
+}
+
+func TestHammingMaxCandidates(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		for _, maxCandidates := range []int{0, 100} {
+			xs := &XorShift1024Star{}
+			xs.Init()
+			h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, MaxCandidates: maxCandidates})
+			// All hashes share most blocks, every query hits a huge bucket
+			clusteredDataSet(h, 1, 1000, 10, xs)
+			query := h.hashes[0].Dup()
+			query[1] ^= 0xFFFFF
+			target := query.Dup()
+			target[3] ^= 1
+			h.Add(target)
+
+			candidates := h.Stats().DistanceCandidates
+			approximateQueries := h.Stats().DistanceApproximate
+			sibling := h.ShortestDistance(query)
+			if maxCandidates == 0 {
+				if (sibling.distance != 1) || sibling.Approximate() {
+					t.Errorf("Multiindex %v: expected exact match at distance 1, got %d %v", useMultiindex, sibling.distance, sibling.Approximate())
+				}
+				continue
+			}
+			if !sibling.Approximate() || (sibling.distance <= 1) {
+				t.Errorf("Multiindex %v: expected approximate result, got %d %v", useMultiindex, sibling.distance, sibling.Approximate())
+			}
+			if h.Stats().DistanceApproximate != approximateQueries+1 {
+				t.Errorf("Multiindex %v: expected one approximate query", useMultiindex)
+			}
+			if !useMultiindex && (h.Stats().DistanceCandidates-candidates != uint64(maxCandidates)) {
+				t.Errorf("Expected %d candidates, got %d", maxCandidates, h.Stats().DistanceCandidates-candidates)
+			}
+		}
+	}
+	if _, err := New(Config{HashSize: 256, MaxDistance: 35, MaxCandidates: -1}); err == nil {
+		t.Errorf("Expected an error for negative MaxCandidates")
+	}
+
+	// The removed hashes do not spend the candidates of the brute force
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, MaxCandidates: 10})
+	for i := 0; i < 20; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.RemoveBulk(append([]FuzzyHash{}, h.hashes[:10]...))
+	query := PerturbHash(h.hashes[15], 1, 1)
+	if sibling := h.ShortestDistance(query); (sibling.distance != 1) || sibling.Approximate() {
+		t.Errorf("Expected exact match at distance 1, got %d %v", sibling.distance, sibling.Approximate())
+	}
+	if sibling := h.Freeze().ShortestDistance(query); (sibling.distance != 1) || sibling.Approximate() {
+		t.Errorf("Frozen: expected exact match at distance 1, got %d %v", sibling.distance, sibling.Approximate())
+	}
+}
+
+func TestHammingMaxBucketScan(t *testing.T) {
+	var candidates [2]uint64
+	for i, maxBucketScan := range []int{0, 100} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, MaxBucketScan: maxBucketScan})
+		// The cluster fills huge buckets
+		clusteredDataSet(h, 1, 1000, 10, xs)
+		for i := 0; i < 500; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+
+		skippedBuckets := h.Stats().DistanceSkippedBuckets
+		start := h.Stats().DistanceCandidates
+		for j := 1000; j < 1500; j += 10 {
+			// Small buckets only
+			if sibling := h.ShortestDistance(PerturbHash(h.hashes[j], 3, 1)); !sibling.s.IsEqual(h.hashes[j]) {
+				t.Errorf("Max bucket scan %d: failed to find hash %d", maxBucketScan, j)
+			}
+		}
+		for j := 0; j < 1000; j += 10 {
+			h.ShortestDistance(PerturbHash(h.hashes[j], 3, 1))
+		}
+		candidates[i] = h.Stats().DistanceCandidates - start
+		if skipped := h.Stats().DistanceSkippedBuckets - skippedBuckets; (maxBucketScan == 0) != (skipped == 0) {
+			t.Errorf("Max bucket scan %d: skipped %d buckets", maxBucketScan, skipped)
+		}
+	}
+	if candidates[1] > candidates[0]/4 {
+		t.Errorf("Expected less candidates, got %d and %d", candidates[0], candidates[1])
+	}
+	if _, err := New(Config{HashSize: 256, MaxDistance: 35, MaxBucketScan: -1}); err == nil {
+		t.Errorf("Expected an error for negative MaxBucketScan")
+	}
+}
+
+func TestHammingSlowQuery(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	var slowQueries []FuzzyHash
+	var slowCandidates []int
+	config := Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, SlowQueryThreshold: 400,
+		OnSlowQuery: func(query FuzzyHash, candidates int) {
+			slowQueries = append(slowQueries, query)
+			slowCandidates = append(slowCandidates, candidates)
+		},
+	}
+	h, _ := New(config)
+	// The cluster fills the same buckets
+	clusteredDataSet(h, 1, 500, 10, xs)
+	for i := 0; i < 500; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+
+	// The complement of the center differs from the center in every block,
+	// the members of the cluster are at most 10 bits from the center
+	far := h.hashes[0].Dup()
+	for i := range far {
+		far[i] = ^far[i]
+	}
+	h.ShortestDistance(far)
+	if len(slowQueries) != 0 {
+		t.Errorf("Unexpected slow query with %v candidates", slowCandidates)
+	}
+	query := PerturbHash(h.hashes[0], 5, 1)
+	h.ShortestDistance(query)
+	if (len(slowQueries) != 1) || !slowQueries[0].IsEqual(query) || (slowCandidates[0] < 500) {
+		t.Errorf("Expected one slow query with at least 500 candidates, got %v", slowCandidates)
+	}
+	// An exact match does not check the candidates
+	h.ShortestDistance(h.hashes[0])
+	if len(slowQueries) != 1 {
+		t.Errorf("Unexpected slow query with %v candidates", slowCandidates)
+	}
+
+	config.UseMultiindex = false
+	config.SlowQueryThreshold = 1000
+	h, _ = New(config)
+	for i := 0; i < 1001; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.ShortestDistance(randomFuzzyHash(256, xs))
+	if (len(slowQueries) != 2) || (slowCandidates[1] != 1001) {
+		t.Errorf("Expected a slow query with 1001 candidates, got %v", slowCandidates)
+	}
+}
+
+func TestHammingRandomizeTies(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		for _, randomizeTies := range []bool{true, false} {
+			h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, RandomizeTies: randomizeTies, TiesSeed: 1})
+			query := FuzzyHash{0x00, 0x00, 0x00, 0x00}
+			// Four hashes at distance 1
+			ties := []FuzzyHash{{0x01, 0x00, 0x00, 0x00}, {0x00, 0x02, 0x00, 0x00}, {0x00, 0x00, 0x04, 0x00}, {0x00, 0x00, 0x00, 0x08}}
+			h.AddBulk(ties)
+			h.Add(FuzzyHash{0x00, 0x00, 0x00, 0x03})
+			const trials = 4000
+			counts := make([]int, len(ties))
+			for i := 0; i < trials; i++ {
+				sibling := h.ShortestDistance(query)
+				for j, fh := range ties {
+					if sibling.s.IsEqual(fh) {
+						counts[j]++
+					}
+				}
+			}
+			for j, count := range counts {
+				expected := trials / len(ties)
+				if !randomizeTies {
+					// The smallest hash
+					expected = 0
+					if j == len(ties)-1 {
+						expected = trials
+					}
+					if count != expected {
+						t.Errorf("Multiindex %v: expected %v, got %v", useMultiindex, expected, counts)
+					}
+					continue
+				}
+				if (count < expected*8/10) || (count > expected*12/10) {
+					t.Errorf("Multiindex %v: expected roughly %d for every tie, got %v", useMultiindex, expected, counts)
+				}
+			}
+		}
+	}
+}
+
+func TestHammingTieBreaker(t *testing.T) {
+	// Four hashes at distance 1
+	ties := []FuzzyHash{{0x01, 0x00, 0x00, 0x00}, {0x00, 0x02, 0x00, 0x00}, {0x00, 0x00, 0x04, 0x00}, {0x00, 0x00, 0x00, 0x08}}
+	query := FuzzyHash{0x00, 0x00, 0x00, 0x00}
+	for _, useMultiindex := range []bool{true, false} {
+		for j, preferred := range ties {
+			preferred := preferred
+			tieBreaker := func(a, b FuzzyHash) bool { return a.IsEqual(preferred) }
+			h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, RandomizeTies: true, TieBreaker: tieBreaker})
+			h.AddBulk(ties)
+			h.Add(FuzzyHash{0x00, 0x00, 0x00, 0x03})
+			for i := 0; i < 10; i++ {
+				if sibling := h.ShortestDistance(query); !sibling.s.IsEqual(preferred) || (sibling.distance != 1) {
+					t.Fatalf("Multiindex %v: expected tie %d, got %s", useMultiindex, j, sibling.s.ToString())
+				}
+			}
+		}
+
+		// Prefer a larger hash
+		higher := func(a, b FuzzyHash) bool { return b.less(a) }
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, TieBreaker: higher})
+		h.AddBulk(ties)
+		if sibling := h.ShortestDistance(query); !sibling.s.IsEqual(ties[0]) {
+			t.Errorf("Multiindex %v: expected the largest hash, got %s", useMultiindex, sibling.s.ToString())
+		}
+
+		// Default is the smallest hash in any order of insertion
+		for shift := range ties {
+			h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+			h.AddBulk(append(append([]FuzzyHash{}, ties[shift:]...), ties[:shift]...))
+			if sibling := h.ShortestDistance(query); !sibling.s.IsEqual(ties[3]) {
+				t.Errorf("Multiindex %v: shift %d: expected the smallest hash, got %s", useMultiindex, shift, sibling.s.ToString())
+			}
+		}
+	}
+}
+
+func TestHammingContainsNear(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 1000; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		for i := 0; i < 100; i++ {
+			query := PerturbHash(h.hashes[i], 5, int64(i))
+			for _, maxDistance := range []int{0, 4, 5, 10, 40} {
+				// Random hashes are ~128 bits apart
+				if expected := maxDistance >= 5; h.ContainsNear(query, maxDistance) != expected {
+					t.Errorf("Multiindex %v: distance 5, max distance %d: expected %v", useMultiindex, maxDistance, expected)
+				}
+			}
+		}
+		if !h.ContainsNear(h.hashes[0], 0) {
+			t.Errorf("Multiindex %v: expected an exact match", useMultiindex)
+		}
+		if h.ContainsNear(FuzzyHash{0x01}, 100) || h.ContainsNear(h.hashes[0], -1) {
+			t.Errorf("Multiindex %v: expected false for bad arguments", useMultiindex)
+		}
+	}
+}
+
+func TestHammingDedupFilter(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		filter := h.DedupFilter(10)
+		const clusters, clusterSize = 20, 10
+		centers := make([]FuzzyHash, clusters)
+		for i := range centers {
+			centers[i] = randomFuzzyHash(256, xs)
+		}
+		// The clusters are interleaved, the center of a cluster comes
+		// first, the near duplicates are at most 5 bits away
+		for j := 0; j < clusterSize; j++ {
+			for i, center := range centers {
+				hash := center
+				if j > 0 {
+					hash = PerturbHash(center, 1+(i+j)%5, int64(i*clusterSize+j))
+				}
+				if passed := filter(hash); passed != (j == 0) {
+					t.Errorf("Multiindex %v: cluster %d hash %d: expected %v, got %v", useMultiindex, i, j, j == 0, passed)
+				}
+			}
+		}
+		if h.Count() != clusters {
+			t.Errorf("Multiindex %v: expected %d hashes, got %d", useMultiindex, clusters, h.Count())
+		}
+		if !filter(PerturbHash(centers[0], 11, 0)) {
+			t.Errorf("Multiindex %v: expected a hash 11 bits away to pass", useMultiindex)
+		}
+		if filter(FuzzyHash{1}) {
+			t.Errorf("Multiindex %v: expected hash of wrong size to fail", useMultiindex)
+		}
+	}
+}
+
+var blockPopcountsTests = []struct {
+	hash      FuzzyHash
+	blockSize int
+	popcounts []int
+}{
+	{FuzzyHash{0x0}, 16, []int{0, 0, 0, 0}},
+	{FuzzyHash{0xFFFF000000FF0001}, 16, []int{1, 8, 0, 16}},
+	{FuzzyHash{0x8000000000000003}, 30, []int{2, 0, 1}},
+	{FuzzyHash{0xF, 0xFFFFFFFFFFFFFFFF}, 100, []int{68, 0}},
+	{FuzzyHash{0x1, 0x1}, 128, []int{2}},
+	{FuzzyHash{0x1, 0x1}, 256, []int{2}},
+	{FuzzyHash{0x1}, 0, nil},
+}
+
+func TestFuzzyHashBlockPopcounts(t *testing.T) {
+	for testID, test := range blockPopcountsTests {
+		popcounts := test.hash.BlockPopcounts(test.blockSize)
+		if !reflect.DeepEqual(popcounts, test.popcounts) {
+			t.Errorf("Test %d: expected %v, got %v", testID, test.popcounts, popcounts)
+		}
+	}
+}
+
+func TestHammingContainsWithin(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 1000; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		for i := 0; i < 50; i++ {
+			query := PerturbHash(h.hashes[i], 8, int64(i))
+			if h.ContainsWithin(query, 7) || !h.ContainsWithin(query, 8) || !h.ContainsWithin(query, 35) {
+				t.Errorf("Multiindex %v: query %d: wrong result", useMultiindex, i)
+			}
+		}
+		// hashes[0] is the first candidate in both modes
+		queries, candidates := h.Stats().ContainsWithin, h.Stats().ContainsWithinCandidates
+		if !h.ContainsWithin(h.hashes[0], 0) {
+			t.Errorf("Multiindex %v: expected an exact match", useMultiindex)
+		}
+		if (h.Stats().ContainsWithin != queries+1) || (h.Stats().ContainsWithinCandidates-candidates > uint64(h.blocks)) {
+			t.Errorf("Multiindex %v: expected an early exit, got %d candidates", useMultiindex, h.Stats().ContainsWithinCandidates-candidates)
+		}
+		if h.ContainsWithin(FuzzyHash{0x01}, 256) {
+			t.Errorf("Multiindex %v: unexpected match for a bad hash", useMultiindex)
+		}
+	}
+}
+
+func TestHammingCountExisting(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	var batch []FuzzyHash
+	for i := 0; i < 200; i++ {
+		fh := randomFuzzyHash(256, xs)
+		if i%2 == 0 {
+			h.Add(fh)
+		}
+		batch = append(batch, fh)
+	}
+	count := h.Count()
+	if existing := h.CountExisting(batch); existing != 100 {
+		t.Errorf("Expected 100 existing hashes, got %d", existing)
+	}
+	if h.Count() != count {
+		t.Errorf("Expected %d hashes, got %d", count, h.Count())
+	}
+	if existing := h.CountExisting([]FuzzyHash{batch[0], batch[0], {0x01}}); existing != 2 {
+		t.Errorf("Expected 2 existing hashes, got %d", existing)
+	}
+}
+
+func TestHammingShortestDistanceOK(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		query := randomFuzzyHash(256, xs)
+		if sibling, ok := h.ShortestDistanceOK(query); ok || sibling.s != nil {
+			t.Errorf("Multiindex %v: expected no sibling in an empty DB, got %v", useMultiindex, sibling)
+		}
+		h.Add(randomFuzzyHash(256, xs))
+		if _, ok := h.ShortestDistanceOK(FuzzyHash{0x01}); ok {
+			t.Errorf("Multiindex %v: expected no sibling for a bad hash", useMultiindex)
+		}
+		if sibling, ok := h.ShortestDistanceOK(PerturbHash(h.hashes[0], 200, 0)); ok != !useMultiindex {
+			// A far hash shares no blocks with the query
+			t.Errorf("Multiindex %v: unexpected result for a far hash %v %v", useMultiindex, sibling, ok)
+		}
+		if sibling, ok := h.ShortestDistanceOK(PerturbHash(h.hashes[0], 3, 0)); !ok || sibling.distance != 3 {
+			t.Errorf("Multiindex %v: expected distance 3, got %v %v", useMultiindex, sibling, ok)
+		}
+	}
+}
+
+func TestHammingShortestDistanceExact(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 100; i++ {
+			h.Add(randomFuzzyHash(256, xs))
 		}
-		for _, hash := range test.hashes {
+		if sibling, exact := h.ShortestDistanceExact(h.hashes[3]); !exact || !sibling.s.IsEqual(h.hashes[3]) {
+			t.Errorf("Multiindex %v: expected an exact match, got %v %v", useMultiindex, sibling, exact)
+		}
+		if sibling, exact := h.ShortestDistanceExact(PerturbHash(h.hashes[3], 1, 0)); exact || (sibling.distance != 1) {
+			t.Errorf("Multiindex %v: expected distance 1, got %v %v", useMultiindex, sibling, exact)
+		}
+		if _, exact := h.ShortestDistanceExact(randomFuzzyHash(256, xs)); exact {
+			t.Errorf("Multiindex %v: unexpected exact match for a random hash", useMultiindex)
+		}
+	}
+}
+
+func TestHammingShortestDistanceCtx(t *testing.T) {
+	configs := []Config{
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: true},
+		{HashSize: 256, MaxDistance: 35, UseMultiindex: false},
+		{HashSize: 200, MaxDistance: 20, UseMultiindex: true},
+	}
+	for _, config := range configs {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(config)
+		for i := 0; i < 1000; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		h.RehashSafe()
+		ctx := h.NewReadCtx()
+		var queries []FuzzyHash
+		for i := 0; i < 100; i++ {
+			query := h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+			query[0] ^= xs.Uint64() & xs.Uint64() & xs.Uint64()
+			queries = append(queries, randomFuzzyHash(256, xs), query, h.hashes[i])
+		}
+		queries = append(queries, FuzzyHash{0x01})
+		for i, query := range queries {
+			if sibling, expected := h.ShortestDistanceCtx(ctx, query), h.ShortestDistance(query); !sibling.isEqual(expected) {
+				t.Fatalf("%+v: query %d: expected %v, got %v", config, i, expected, sibling)
+			}
+		}
+		allocs := testing.AllocsPerRun(10, func() {
+			for _, query := range queries {
+				h.ShortestDistanceCtx(ctx, query)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("%+v: expected no allocations, got %v", config, allocs)
+		}
+	}
+}
+
+func TestHammingKNearest(t *testing.T) {
+	// Distances from the zero hash: 1, 1, 1, 2, 2, 3, 64
+	hashes := []FuzzyHash{
+		{0x00, 0xFFFFFFFFFFFFFFFF},
+		{0x00, 0x07},
+		{0x00, 0x10},
+		{0x01, 0x01},
+		{0x00, 0x03},
+		{0x00, 0x08},
+		{0x80, 0x00},
+	}
+	expected := []FuzzyHash{{0x00, 0x08}, {0x00, 0x10}, {0x80, 0x00}, {0x00, 0x03}, {0x01, 0x01}, {0x00, 0x07}}
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 128, MaxDistance: 7, UseMultiindex: useMultiindex})
+		h.AddBulk(hashes)
+		siblings := h.KNearest(FuzzyHash{0x00, 0x00}, 6)
+		if len(siblings) != len(expected) {
+			t.Fatalf("Multiindex %v: expected %d siblings, got %v", useMultiindex, len(expected), siblings)
+		}
+		for i, sibling := range siblings {
+			if !sibling.s.IsEqual(expected[i]) || sibling.distance != distanceUint64s(sibling.s, FuzzyHash{0x00, 0x00}) {
+				t.Errorf("Multiindex %v: sibling %d: expected %s, got %v", useMultiindex, i, expected[i].ToString(), sibling)
+			}
+		}
+		// The ties are broken the same way for any k
+		if siblings := h.KNearest(FuzzyHash{0x00, 0x00}, 2); !siblings[1].s.IsEqual(expected[1]) {
+			t.Errorf("Multiindex %v: expected %s, got %v", useMultiindex, expected[1].ToString(), siblings)
+		}
+		if siblings := h.KNearest(FuzzyHash{0x00, 0x00}, 0); siblings != nil {
+			t.Errorf("Multiindex %v: expected no siblings, got %v", useMultiindex, siblings)
+		}
+	}
+}
+
+func TestHammingWithin(t *testing.T) {
+	tests := []struct {
+		sampleHash string
+		d          int
+		distances  []int
+	}{
+		{allZerosHash, 0, []int{0}},
+		{allZerosHash, 3, []int{0, 1, 2, 3}},
+		{allZerosHash, 35, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"0000000000000000000000000000000000000000000000000000000000000111", 1, []int{0, 1, 1}},
+		{"0000000000000000000000000000000000000000000000000000000000000111", 2, []int{0, 1, 1, 2, 2}},
+		{allFsHash, 35, nil},
+	}
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for _, hash := range hammingDistanceTests[0].hashes {
 			fh, _ := HashStringToFuzzyHash(hash)
-			if !h.Add(fh) {
-				t.Errorf("Test %d failed", testID)
+			h.Add(fh)
+		}
+		for testID, test := range tests {
+			fh, _ := HashStringToFuzzyHash(test.sampleHash)
+			siblings := h.Within(fh, test.d)
+			if len(siblings) != len(test.distances) {
+				t.Errorf("Multiindex %v: test %d: expected %v, got %v", useMultiindex, testID, test.distances, siblings)
+				continue
 			}
-			if !h.Contains(fh) {
-				t.Errorf("Test %d failed", testID)
+			for i, sibling := range siblings {
+				if sibling.distance != test.distances[i] || distanceUint64s(fh, sibling.s) != sibling.distance {
+					t.Errorf("Multiindex %v: test %d: expected %v, got %v", useMultiindex, testID, test.distances, siblings)
+				}
 			}
 		}
-		fh, _ := HashStringToFuzzyHash(test.sampleHash)
-		bestSibling := h.ShortestDistance(fh)
-		if bestSibling.distance != test.bestSibling.distance {
-			t.Errorf("Test %d failed: expected %d got %d", testID, test.bestSibling.distance, bestSibling.distance)
+		// The siblings at distance 1 from 0x111 are 0x011 and 0x1111 in the order of insertion
+		fh, _ := HashStringToFuzzyHash(tests[3].sampleHash)
+		if siblings := h.Within(fh, 1); !siblings[1].s.IsEqual(h.hashes[2]) || !siblings[2].s.IsEqual(h.hashes[4]) {
+			t.Errorf("Multiindex %v: unexpected order %v", useMultiindex, siblings)
 		}
-		if !bestSibling.s.IsEqual(test.bestSibling.s) {
-			t.Errorf("Test %d failed: expected %s got %s", testID, test.bestSibling.s.ToString(), bestSibling.s.ToString())
+	}
+}
+
+func TestHammingAllShortest(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 100; i++ {
+			h.Add(randomFuzzyHash(256, xs))
 		}
-		siblingBruteForce := h.shortestDistanceBruteForce(fh)
-		if !bestSibling.isEqual(siblingBruteForce) {
-			t.Errorf("Test %d failed: expected %s got %s", testID, bestSibling.s.ToString(), siblingBruteForce.s.ToString())
+		query := randomFuzzyHash(256, xs)
+		// Two hashes at distance 2 and one hash at distance 3
+		first, second, third := query.Dup(), query.Dup(), query.Dup()
+		first[0] ^= 0x03
+		second[1] ^= 0x01
+		second[3] ^= 0x01
+		third[2] ^= 0x07
+		h.AddBulk([]FuzzyHash{third, second, first})
+
+		siblings := h.AllShortest(query)
+		if len(siblings) != 2 {
+			t.Fatalf("Multiindex %v: expected 2 siblings, got %v", useMultiindex, siblings)
+		}
+		for i, expected := range []FuzzyHash{second, first} {
+			if !siblings[i].s.IsEqual(expected) || siblings[i].distance != 2 {
+				t.Errorf("Multiindex %v: sibling %d: expected %s, got %v", useMultiindex, i, expected.ToString(), siblings[i])
+			}
+		}
+		if siblings := h.AllShortest(first); len(siblings) != 1 || siblings[0].distance != 0 {
+			t.Errorf("Multiindex %v: expected an exact match, got %v", useMultiindex, siblings)
+		}
+		if siblings := h.AllShortest(FuzzyHash{0x01}); len(siblings) != 0 {
+			t.Errorf("Multiindex %v: expected no siblings for a bad hash, got %v", useMultiindex, siblings)
 		}
 	}
 }
 
-func TestHammingDup(t *testing.T) {
-	fh, _ := HashStringToFuzzyHash(allFsHash)
+func TestHammingStats(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for i := 0; i < 100; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		for i := 0; i < 3; i++ {
+			h.ShortestDistance(h.hashes[i].Dup())
+		}
+		for i := 0; i < 5; i++ {
+			h.ShortestDistance(PerturbHash(h.hashes[i], 10, int64(i)))
+		}
+		for i := 0; i < 7; i++ {
+			h.ShortestDistance(PerturbHash(h.hashes[i], 100, int64(i)))
+		}
+		expected := h.Stats()
+		if (expected.ExactMatches != 3) || (expected.WithinThreshold != 5) || (expected.BeyondThreshold != 7) {
+			t.Errorf("Multiindex %v: unexpected results %+v", useMultiindex, expected)
+		}
+		if (expected.Distance != 15) || (expected.AddIndex != 100) {
+			t.Errorf("Multiindex %v: unexpected counters %+v", useMultiindex, expected)
+		}
+		if useMultiindex && ((expected.MaxCandidatesSeen == 0) || (expected.MaxCandidatesSeen > 100)) {
+			t.Errorf("Unexpected max candidates %d", expected.MaxCandidatesSeen)
+		}
+		if !useMultiindex && (expected.MaxCandidatesSeen != 0) {
+			t.Errorf("Unexpected max candidates %d", expected.MaxCandidatesSeen)
+		}
+		if stats := h.Dup().Stats(); stats != expected {
+			t.Errorf("Multiindex %v: clone: expected %+v, got %+v", useMultiindex, expected, stats)
+		}
+	}
+}
+
+func TestHammingStatsPerInstance(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h1, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	h2, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: false})
+	for i := 0; i < 100; i++ {
+		h1.Add(randomFuzzyHash(256, xs))
+	}
+	h2.Add(randomFuzzyHash(256, xs))
+	h2.Add(h2.hashes[0].Dup())
+	for i := 0; i < 10; i++ {
+		h1.ShortestDistance(h1.hashes[i].Dup())
+	}
+	h2.ShortestDistance(randomFuzzyHash(256, xs))
+
+	if stats := h1.Stats(); (stats.AddIndex != 100) || (stats.AddIndexExists != 0) || (stats.Distance != 10) || (stats.ExactMatches != 10) {
+		t.Errorf("Unexpected counters of the first instance %+v", stats)
+	}
+	if stats := h2.Stats(); (stats.AddIndex != 2) || (stats.AddIndexExists != 1) || (stats.Distance != 1) || (stats.ExactMatches != 0) {
+		t.Errorf("Unexpected counters of the second instance %+v", stats)
+	}
+	h1.StatsAndReset()
+	if stats := h2.Stats(); stats.AddIndex != 2 {
+		t.Errorf("Reset of the first instance modified the second instance %+v", stats)
+	}
+	if stats := GetStatistics(); stats != h2.Stats() {
+		t.Errorf("Expected the counters of the last instance, got %+v", stats)
+	}
+}
+
+func TestHammingResetStats(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
 	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
-	h.Add(fh)
-	sibling := h.ShortestDistance(fh)
-	if sibling.distance != 0 || !sibling.s.IsEqual(fh) {
-		t.Errorf("Failed to find sibling: got distance %d, hash %s %v", sibling.distance, sibling.s.ToString(), h.multiIndexTables)
+	for run := 0; run < 3; run++ {
+		for i := 0; i < 10; i++ {
+			h.Add(randomFuzzyHash(256, xs))
+		}
+		h.ShortestDistance(h.hashes[0].Dup())
+		if stats := h.Stats(); (stats.AddIndex != 10) || (stats.Distance != 1) || (stats.ExactMatches != 1) {
+			t.Errorf("Run %d: unexpected counters %+v", run, stats)
+		}
+		h.ResetStats()
+		if stats := h.Stats(); stats != (Statistics{}) {
+			t.Errorf("Run %d: expected zero counters, got %+v", run, stats)
+		}
 	}
-	h = h.Dup()
-	sibling = h.ShortestDistance(fh)
-	if sibling.distance != 0 || !sibling.s.IsEqual(fh) {
-		t.Errorf("Failed to find sibling: got distance %d, hash %s", sibling.distance, sibling.s.ToString())
+}
+
+// Try "go test -race -run Concurrent"
+func TestHammingConcurrentAtomicStats(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, AtomicStats: true})
+	done := make(chan struct{})
+	monitor := make(chan uint64)
+	go func() {
+		added := uint64(0)
+		for {
+			stats := h.Stats()
+			if stats.AddIndex < added {
+				t.Errorf("Counter went backwards %d < %d", stats.AddIndex, added)
+			}
+			added = stats.AddIndex
+			select {
+			case <-done:
+				monitor <- added
+				return
+			default:
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
 	}
-	siblingBruteForce := h.shortestDistanceBruteForce(fh)
-	if !sibling.isEqual(siblingBruteForce) {
-		t.Errorf("Failed to brute force: expected %s got %s", sibling.s.ToString(), siblingBruteForce.s.ToString())
+	close(done)
+	if added := <-monitor; added > 1000 {
+		t.Errorf("Expected at most 1000 adds, got %d", added)
+	}
+	if stats := h.Stats(); stats.AddIndex != 1000 {
+		t.Errorf("Expected 1000 adds, got %d", stats.AddIndex)
+	}
+}
+
+func TestHammingMaxCandidatesSeen(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for i := 0; i < 100; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.ShortestDistance(randomFuzzyHash(256, xs))
+	small := h.Stats().MaxCandidatesSeen
+	// 500 hashes in the bucket 0 of block 0
+	for i := 0; i < 500; i++ {
+		fh := randomFuzzyHash(256, xs)
+		fh[3] &^= 0x7F
+		h.Add(fh)
+	}
+	bucket := len(h.multiIndexTables[0][0])
+	query := randomFuzzyHash(256, xs)
+	query[3] &^= 0x7F
+	h.ShortestDistance(query)
+	if seen := h.Stats().MaxCandidatesSeen; (seen < uint64(bucket)) || (seen > uint64(h.Count())) || (bucket < 500) {
+		t.Errorf("Expected at least %d candidates, got %d", bucket, seen)
+	}
+	// A query with fewer candidates does not lower the mark
+	seen := h.Stats().MaxCandidatesSeen
+	// The block 0 of the query is not zero, the query misses the large bucket
+	query = PerturbHash(h.hashes[0], 1, 0)
+	query[3] |= 1
+	h.ShortestDistance(query)
+	if h.StatsAndReset().MaxCandidatesSeen != seen || seen <= small {
+		t.Errorf("Expected the high-water mark %d", seen)
+	}
+	if h.Stats().MaxCandidatesSeen != 0 {
+		t.Errorf("Expected zero after reset, got %d", h.Stats().MaxCandidatesSeen)
+	}
+}
+
+// Try "go test -race -run Concurrent"
+func TestHammingConcurrentQueries(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 1000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	queries := make([]FuzzyHash, 100)
+	expected := make([]Sibling, len(queries))
+	for i := range queries {
+		queries[i] = h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+		queries[i][0] &= xs.Uint64()
+		expected[i] = h.ShortestDistance(queries[i])
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, query := range queries {
+				sibling := h.ShortestDistance(query)
+				if !sibling.isEqual(expected[i]) {
+					t.Errorf("Query %d: expected %d got %d", i, expected[i].distance, sibling.distance)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHammingConcurrentStatsAndReset(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 1000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	queries := make([]FuzzyHash, 100)
+	for i := range queries {
+		queries[i] = PerturbHash(h.hashes[i], i%50, int64(i))
+	}
+
+	const workers = 4
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, query := range queries {
+				h.ShortestDistance(query)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	total := make(chan uint64)
+	go func() {
+		sum := uint64(0)
+		for {
+			stats := h.StatsAndReset()
+			sum += stats.ExactMatches + stats.WithinThreshold + stats.BeyondThreshold
+			select {
+			case <-done:
+				total <- sum
+				return
+			default:
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	sum := <-total
+	stats := h.StatsAndReset()
+	sum += stats.ExactMatches + stats.WithinThreshold + stats.BeyondThreshold
+	if sum != workers*uint64(len(queries)) {
+		t.Errorf("Expected %d queries, got %d", workers*len(queries), sum)
+	}
+	if stats := h.Stats(); stats != (Statistics{}) {
+		t.Errorf("Expected zero counters, got %+v", stats)
 	}
 }
 
@@ -418,29 +2614,26 @@ func TestLoadRealData(t *testing.T) {
 		t.Errorf("Failed to open file '%s' %v", dataSetFilename, err)
 	}
 	defer dataFile.Close()
+	// The size of the hash in the first line is the size of all hashes
 	reader := bufio.NewReader(dataFile)
+	firstLine, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		t.Fatalf("Failed to read file '%s' %v", dataSetFilename, err)
+	}
+	hashSize := 8 * len(strings.TrimSpace(firstLine)) / 2 // bits
+	realDataTest, err = New(Config{HashSize: hashSize, MaxDistance: dataSetMaximumDistance, UseMultiindex: true})
+	if err != nil {
+		t.Fatalf("Failed to create multi-index file '%s' %v", dataSetFilename, err)
+	}
+	if _, err := realDataTest.LoadCSV(io.MultiReader(strings.NewReader(firstLine), reader)); err != nil {
+		t.Errorf("Failed to load file '%s' %v", dataSetFilename, err)
+	}
 	var lastHash FuzzyHash
-	for {
-		line, _, err := reader.ReadLine()
-		if err == io.EOF {
-			break
-		}
-		if realDataTest == nil {
-			hashSize := 8 * len(line) / 2 // bits
-			realDataTest, err = New(Config{HashSize: hashSize, MaxDistance: dataSetMaximumDistance, UseMultiindex: true})
-			if err != nil {
-				t.Errorf("Failed to create multi-index file '%s' %v", dataSetFilename, err)
-			}
-		}
-		fh, err := HashStringToFuzzyHash(string(line))
-		if err != nil {
-			t.Errorf("Failed to parse hash string %s from file '%s' %v", line, dataSetFilename, err)
-		}
-		realDataTest.Add(fh)
-		lastHash = fh
-		if !realDataTest.Contains(lastHash) {
-			t.Errorf("Failed to add hash %s", lastHash.ToString())
+	for _, hash := range realDataTest.hashes {
+		if !realDataTest.Contains(hash) {
+			t.Errorf("Failed to add hash %s", hash.ToString())
 		}
+		lastHash = hash
 	}
 	hashesCount := len(realDataTest.hashes)
 	t.Logf("Loaded %d hashes from the file '%s'", hashesCount, dataSetFilename)
@@ -476,9 +2669,10 @@ func (x *XorShift1024Star) Uint64() uint64 {
 }
 
 func (x *XorShift1024Star) Init() {
-	rand.Seed(999)
+	// rand.Seed() does not seed the global generator since Go 1.24
+	random := rand.New(rand.NewSource(999))
 	for i := 0; i < len(x.s); i++ {
-		x.s[i] = rand.Uint64()
+		x.s[i] = random.Uint64()
 	}
 	x.p = 0
 }
@@ -522,7 +2716,7 @@ func benchmarkRealDataSet(count int, hashCollision int, b *testing.B) {
 	hashesCount := len(realDataTest.hashes)
 	xs := &XorShift1024Star{}
 	xs.Init()
-	statistics = &Statistics{}
+	realDataTest.StatsAndReset()
 	var fh FuzzyHash = make([]uint64, 4)
 	if hashCollision == hashCollisionNone {
 		for i := 0; i < len(fh); i++ { // generate a random hash
@@ -545,7 +2739,7 @@ func benchmarkRealDataSet(count int, hashCollision int, b *testing.B) {
 			realDataTest.ShortestDistance(fh)
 		}
 	}
-	b.Logf("\n%s\n", sprintf.SprintfStructure(*statistics, 2, "", nil))
+	b.Logf("\n%s\n", sprintf.SprintfStructure(realDataTest.Stats(), 2, "", nil))
 }
 
 func BenchmarkRealDataSet(b *testing.B) {
@@ -601,7 +2795,7 @@ func benchmarkUniformDataSet(setSize int, count int, b *testing.B) {
 	b.ResetTimer()
 
 	hashesCount := len(h.hashes)
-	statistics = &Statistics{}
+	h.StatsAndReset()
 	for i := 0; i < b.N; i++ {
 		for k := 0; k < count; k++ {
 			// Pick a random hash from the data set
@@ -612,7 +2806,7 @@ func benchmarkUniformDataSet(setSize int, count int, b *testing.B) {
 			h.shortestDistanceBruteForce(fh)
 		}
 	}
-	b.Logf("\n%s\n", sprintf.SprintfStructure(*statistics, 2, "", nil))
+	b.Logf("\n%s\n", sprintf.SprintfStructure(h.Stats(), 2, "", nil))
 }
 
 func BenchmarkUniformDataSet300K1(b *testing.B) {
@@ -631,6 +2825,41 @@ func BenchmarkUniformDataSet1M1(b *testing.B) {
 	benchmarkUniformDataSet(1000*1000, 1, b)
 }
 
+// All threads share the same read only H
+func benchmarkConcurrentQueries(setSize int, useMultiindex bool, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < setSize; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	queries := make([]FuzzyHash, 1024)
+	for i := range queries {
+		// Modify between 0 to 63 bits of a random hash from the data set
+		queries[i] = h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+		queries[i][0] &= xs.Uint64()
+	}
+	h.StatsAndReset()
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			h.ShortestDistance(queries[i%len(queries)])
+		}
+	})
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "queries/s")
+	b.Logf("\n%s\n", sprintf.SprintfStructure(h.Stats(), 2, "", nil))
+}
+
+func BenchmarkConcurrentQueries(b *testing.B) {
+	benchmarkConcurrentQueries(100*1000, true, b)
+}
+
+func BenchmarkConcurrentQueriesBruteForce(b *testing.B) {
+	benchmarkConcurrentQueries(100*1000, false, b)
+}
+
 func benchmarkHammingAdd(h *H, count int, b *testing.B) {
 	for i := 0; i < count; i++ {
 		fh, _ := HashStringToFuzzyHash(allFsHash) // This line dominates add()
@@ -660,6 +2889,30 @@ func BenchmarkHammingAdd1M(b *testing.B) {
 	}
 }
 
+// Construction and load of a DB
+func benchmarkHammingLoad(count int, expectedCount int, b *testing.B) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	hashes := make([]FuzzyHash, count)
+	for i := range hashes {
+		hashes[i] = randomFuzzyHash(256, xs)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ExpectedCount: expectedCount})
+		h.AddBulk(hashes)
+	}
+}
+
+func BenchmarkHammingLoad100K(b *testing.B) {
+	benchmarkHammingLoad(100*1000, 0, b)
+}
+
+func BenchmarkHammingLoad100KExpectedCount(b *testing.B) {
+	benchmarkHammingLoad(100*1000, 100*1000, b)
+}
+
 func BenchmarkFuzzyHashToKey(b *testing.B) {
 	fh, _ := HashStringToFuzzyHash(allFsHash)
 	for i := 0; i < b.N; i++ {
@@ -667,6 +2920,34 @@ func BenchmarkFuzzyHashToKey(b *testing.B) {
 	}
 }
 
+func benchmarkContainsSafeKey(reuseBuffer bool, b *testing.B) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: false})
+	for i := 0; i < 1000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.RehashSafe()
+	fh := h.hashes[10].Dup()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reuseBuffer {
+			h.Contains(fh)
+		} else {
+			_ = h.hashesLookup[string(appendKey(nil, fh))]
+		}
+	}
+}
+
+func BenchmarkContainsSafeKey(b *testing.B) {
+	benchmarkContainsSafeKey(true, b)
+}
+
+func BenchmarkContainsSafeKeyAlloc(b *testing.B) {
+	benchmarkContainsSafeKey(false, b)
+}
+
 func BenchmarkFuzzyHashToString(b *testing.B) {
 	fh, _ := HashStringToFuzzyHash(allFsHash)
 	for i := 0; i < b.N; i++ {
@@ -674,6 +2955,126 @@ func BenchmarkFuzzyHashToString(b *testing.B) {
 	}
 }
 
+func benchmarkShortestDistanceCtx(useCtx bool, b *testing.B) {
+	// Queries of 200 bits hashes have non zero padding
+	h, _ := New(Config{HashSize: 200, MaxDistance: 20, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 10*1000; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	queries := make([]FuzzyHash, 1024)
+	for i := range queries {
+		queries[i] = h.hashes[xs.Uint64()%uint64(len(h.hashes))].Dup()
+		queries[i][0] = xs.Uint64()
+	}
+	ctx := h.NewReadCtx()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if useCtx {
+			h.ShortestDistanceCtx(ctx, queries[i%len(queries)])
+		} else {
+			h.ShortestDistance(queries[i%len(queries)])
+		}
+	}
+}
+
+func BenchmarkShortestDistanceCtx(b *testing.B) {
+	benchmarkShortestDistanceCtx(true, b)
+}
+
+func BenchmarkShortestDistanceNoCtx(b *testing.B) {
+	benchmarkShortestDistanceCtx(false, b)
+}
+
+func benchmarkScoreCandidate(onePass bool, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	query := randomFuzzyHash(256, xs)
+	candidate := PerturbHash(query, 20, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if onePass {
+			h.ScoreCandidate(query, candidate)
+		} else {
+			h.hammingDistance(query, candidate)
+			h.matchingBlocks(query, candidate)
+		}
+	}
+}
+
+func BenchmarkScoreCandidate(b *testing.B) {
+	benchmarkScoreCandidate(true, b)
+}
+
+func BenchmarkScoreCandidateTwoPasses(b *testing.B) {
+	benchmarkScoreCandidate(false, b)
+}
+
+// The order of the blocks does not reduce the work of the full search,
+// candidates/op is the number of candidates before the closest sibling
+func benchmarkReorderBlocks(reorderBlocks bool, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ReorderBlocks: reorderBlocks})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	skewedDataSet(h, 10*1000, xs)
+	h.ReorderBlocks()
+	queries := make([]FuzzyHash, 1024)
+	for i := range queries {
+		queries[i] = PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], 10, int64(i))
+	}
+	candidates := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		candidates += candidatesBeforeBest(h, queries[i%len(queries)])
+	}
+	b.ReportMetric(float64(candidates)/float64(b.N), "candidates/op")
+}
+
+func BenchmarkReorderBlocks(b *testing.B) {
+	benchmarkReorderBlocks(true, b)
+}
+
+func BenchmarkReorderBlocksNatural(b *testing.B) {
+	benchmarkReorderBlocks(false, b)
+}
+
+func BenchmarkFuzzyHashAppendHex(b *testing.B) {
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	buffer := make([]byte, 0, 128)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buffer = fh.AppendHex(buffer[:0])
+	}
+}
+
+// The debug output shall not allocate per candidate
+func benchmarkShortestDistanceDebug(debugOutput io.Writer, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, DebugOutput: debugOutput})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	clusteredDataSet(h, 100, 100, 10, xs)
+	queries := make([]FuzzyHash, 1024)
+	for i := range queries {
+		queries[i] = PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], 20, int64(i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ShortestDistance(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkShortestDistanceDebug(b *testing.B) {
+	benchmarkShortestDistanceDebug(ioutil.Discard, b)
+}
+
+func BenchmarkShortestDistanceNoDebug(b *testing.B) {
+	benchmarkShortestDistanceDebug(nil, b)
+}
+
 func randomFuzzyHash(bits int, xs *XorShift1024Star) FuzzyHash {
 	uint64s := bits / 64
 	fh := make([]uint64, uint64s)
@@ -748,6 +3149,26 @@ func BenchmarkHammingDistance(b *testing.B) {
 	}
 }
 
+func benchmarkPopcountMode(popcountMode PopcountMode, b *testing.B) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, PopcountMode: popcountMode})
+	xs := &XorShift1024Star{}
+	xs.Init()
+	d1 := randomFuzzyHash(512, xs)
+	d2 := randomFuzzyHash(512, xs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.hammingDistance(d1, d2)
+	}
+}
+
+func BenchmarkPopcountHardware(b *testing.B) {
+	benchmarkPopcountMode(PopcountHardware, b)
+}
+
+func BenchmarkPopcountTable(b *testing.B) {
+	benchmarkPopcountMode(PopcountTable, b)
+}
+
 func BenchmarkHashStringToFuzzyHash(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		HashStringToFuzzyHash(allFsHash)
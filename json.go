@@ -0,0 +1,36 @@
+package hamming
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Result is a JSON friendly sibling
+type Result struct {
+	Hash     string `json:"hash"`
+	Distance int    `json:"distance"`
+}
+
+// MarshalJSON encodes the sibling as {"hash":"...","distance":N}
+func (s Sibling) MarshalJSON() ([]byte, error) {
+	return json.Marshal(Result{Hash: s.Hash(), Distance: s.Distance()})
+}
+
+// KNearestJSON returns up to k closest siblings sorted by distance
+// The results are ready for encoding/json
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) KNearestJSON(hash FuzzyHash, k int) ([]Result, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("number of siblings is not positive %d", k)
+	}
+	if !h.validHash(hash) {
+		return nil, fmt.Errorf("hash %s is not %d bits", hash.ToString(), h.config.HashSize)
+	}
+	siblings := h.KNearest(hash, k)
+	results := make([]Result, len(siblings))
+	for i, sibling := range siblings {
+		results[i] = Result{Hash: sibling.Hash(), Distance: sibling.Distance()}
+	}
+	return results, nil
+}
@@ -0,0 +1,69 @@
+package hamming
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHammingKNearestJSON(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex})
+		for _, hash := range hammingDistanceTests[0].hashes {
+			fh, _ := HashStringToFuzzyHash(hash)
+			h.Add(fh)
+		}
+		fh, _ := HashStringToFuzzyHash("0000000000000000000000000000000000000000000000000000000000000001")
+		results, err := h.KNearestJSON(fh, 1)
+		if err != nil {
+			t.Fatalf("Failed to get siblings: %v", err)
+		}
+		data, err := json.Marshal(results)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		expected := `[{"hash":"0000000000000000000000000000000000000000000000000000000000000001","distance":0}]`
+		if string(data) != expected {
+			t.Errorf("Multiindex %v: expected %s, got %s", useMultiindex, expected, data)
+		}
+
+		// Two hashes at distance 1
+		results, _ = h.KNearestJSON(fh, 4)
+		for i, distance := range []int{0, 1, 1, 2} {
+			if results[i].Distance != distance {
+				t.Errorf("Multiindex %v: expected distance %d, got %v", useMultiindex, distance, results[i])
+			}
+		}
+
+		if results, _ = h.KNearestJSON(fh, 100); len(results) != len(hammingDistanceTests[0].hashes) {
+			t.Errorf("Expected %d results, got %d", len(hammingDistanceTests[0].hashes), len(results))
+		}
+		if _, err = h.KNearestJSON(fh, 0); err == nil {
+			t.Errorf("Expected an error for k=0")
+		}
+		if _, err = h.KNearestJSON(FuzzyHash{0x01}, 1); err == nil {
+			t.Errorf("Expected an error for a short hash")
+		}
+	}
+}
+
+func TestSiblingMarshalJSON(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		h.Add(fh)
+	}
+	fh, _ := HashStringToFuzzyHash("0000000000000000000000000000000000000000000000000000000000000003")
+	data, err := json.Marshal(h.ShortestDistance(fh))
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	expected := `{"hash":"0000000000000000000000000000000000000000000000000000000000000001","distance":1}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+
+	data, _ = json.Marshal([]Sibling{{distance: 256}})
+	if expected = `[{"hash":"","distance":256}]`; string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+}
@@ -0,0 +1,289 @@
+package hamming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The snapshot of the DB starts with the magic and the version of the
+// format. All numbers are big endian. The header is followed by
+// the persistentConfig structure,
+// uint32 number of hashes, for every hash one byte 1 and the words or one
+// byte 0 for a removed hash,
+// uint32 number of duplicates, for every duplicate uint32 index of the
+// hash and uint32 number of extra adds,
+// uint32 number of blocks, for every block uint32 number of buckets, for
+// every bucket uint16 value, uint32 length and uint32 indexes of the hashes,
+// uint32 length of the block order, zero for the natural order, and uint32
+// blocks
+var snapshotMagic = []byte("HMNG")
+
+const snapshotVersion = byte(1)
+
+// The largest number of items I allocate before reading them. A broken
+// count does not allocate all memory
+const snapshotMaxPreallocation = 1 << 20
+
+// snapshotWriter keeps the first error. I check the error once in the end
+type snapshotWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(data interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.BigEndian, data)
+	}
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(data interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.BigEndian, data)
+	}
+}
+
+func (sr *snapshotReader) uint32() uint32 {
+	var v uint32
+	sr.read(&v)
+	return v
+}
+
+func preallocation(count uint32) int {
+	if count > snapshotMaxPreallocation {
+		return snapshotMaxPreallocation
+	}
+	return int(count)
+}
+
+// Save writes the DB, including the multi-index tables, to the writer
+// Load() restores the DB without rebuilding the index. I do not store
+// the callbacks and the debug output of the configuration, the removed
+// hashes keep their slots
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) Save(w io.Writer) error {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+	sw.write(snapshotMagic)
+	sw.write(snapshotVersion)
+	sw.write(newPersistentConfig(h.config))
+
+	sw.write(uint32(len(h.hashes)))
+	for _, hash := range h.hashes {
+		if hash == nil {
+			sw.write(byte(0))
+			continue
+		}
+		sw.write(byte(1))
+		sw.write([]uint64(hash))
+	}
+
+	// I do not build the keys, Save() does not modify the DB
+	type duplicate struct {
+		hashIndex uint32
+		count     uint32
+	}
+	duplicates := make([]duplicate, 0, len(h.duplicates))
+	for key, count := range h.duplicates {
+		duplicates = append(duplicates, duplicate{hashIndex: h.hashesLookup[key], count: count})
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i].hashIndex < duplicates[j].hashIndex })
+	sw.write(uint32(len(duplicates)))
+	for _, d := range duplicates {
+		sw.write(d.hashIndex)
+		sw.write(d.count)
+	}
+
+	sw.write(uint32(len(h.multiIndexTables)))
+	for _, indexTable := range h.multiIndexTables {
+		blockValues := make([]int, 0, len(indexTable))
+		for blockValue := range indexTable {
+			blockValues = append(blockValues, int(blockValue))
+		}
+		sort.Ints(blockValues)
+		sw.write(uint32(len(blockValues)))
+		for _, blockValue := range blockValues {
+			hashes := indexTable[uint16(blockValue)]
+			sw.write(uint16(blockValue))
+			sw.write(uint32(len(hashes)))
+			sw.write(hashes)
+		}
+	}
+	sw.write(uint32(len(h.blockOrder)))
+	for _, b := range h.blockOrder {
+		sw.write(uint32(b))
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// Load reads the DB written by Save(). I set the distance function, the
+// block layout and the rest of the state which depends on the
+// configuration as New() does. I rebuild the map of the hashes, the map
+// costs as much to read as to rebuild. I return an error if Verify()
+// fails for the loaded DB
+// Set the callbacks of the configuration with New() and RebuildIndex() if
+// required
+func Load(r io.Reader) (*H, error) {
+	h := &H{}
+	if err := h.load(r); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// GobEncode implements gob.GobEncoder, I encode the snapshot of Save()
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) GobEncode() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := h.Save(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder. I replace the DB with the snapshot
+// like Load() does. The block layout and the distance function depend
+// on the stored configuration
+func (h *H) GobDecode(data []byte) error {
+	return h.load(bytes.NewReader(data))
+}
+
+// load replaces the DB with the snapshot. The DB is zero, like the one
+// New() returns for a bad configuration, if the snapshot is broken or
+// inconsistent
+func (h *H) load(r io.Reader) error {
+	if err := h.readSnapshot(r); err != nil {
+		*h = H{}
+		return err
+	}
+	return nil
+}
+
+func (h *H) readSnapshot(r io.Reader) error {
+	sr := &snapshotReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(snapshotMagic))
+	var version byte
+	sr.read(magic)
+	sr.read(&version)
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the header: %v", sr.err)
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return fmt.Errorf("bad magic %q", magic)
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported version %d, expected %d", version, snapshotVersion)
+	}
+	var pc persistentConfig
+	sr.read(&pc)
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the config: %v", sr.err)
+	}
+	if err := h.init(pc.config()); err != nil {
+		return err
+	}
+
+	words := h.config.words()
+	count := sr.uint32()
+	h.hashes = make([]FuzzyHash, 0, preallocation(count))
+	for i := uint32(0); (i < count) && (sr.err == nil); i++ {
+		var live byte
+		sr.read(&live)
+		if live == 0 {
+			h.hashes = append(h.hashes, nil)
+			continue
+		}
+		hash := make(FuzzyHash, words)
+		sr.read([]uint64(hash))
+		h.hashes = append(h.hashes, hash)
+		h.hashesLookup[h.mapKey(hash)] = i
+	}
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the hashes: %v", sr.err)
+	}
+
+	count = sr.uint32()
+	for i := uint32(0); (i < count) && (sr.err == nil); i++ {
+		hashIndex, duplicates := sr.uint32(), sr.uint32()
+		if sr.err != nil {
+			break
+		}
+		if (hashIndex >= uint32(len(h.hashes))) || (h.hashes[hashIndex] == nil) {
+			return fmt.Errorf("duplicate %d: bad hash index %d", i, hashIndex)
+		}
+		h.duplicates[h.mapKey(h.hashes[hashIndex])] = duplicates
+	}
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the duplicates: %v", sr.err)
+	}
+
+	blocks := sr.uint32()
+	if (sr.err == nil) && (blocks != uint32(len(h.multiIndexTables))) {
+		return fmt.Errorf("expected %d blocks, got %d", len(h.multiIndexTables), blocks)
+	}
+	for b := 0; (b < int(blocks)) && (sr.err == nil); b++ {
+		buckets := sr.uint32()
+		if buckets == 0 {
+			continue
+		}
+		table := make(indexTable, preallocation(buckets))
+		for i := uint32(0); (i < buckets) && (sr.err == nil); i++ {
+			var blockValue uint16
+			sr.read(&blockValue)
+			length := sr.uint32()
+			if (sr.err == nil) && (length > uint32(len(h.hashes))) {
+				return fmt.Errorf("block %d value %x: %d hashes, expected at most %d", b, blockValue, length, len(h.hashes))
+			}
+			hashes := make([]uint32, length)
+			sr.read(hashes)
+			for _, hashIndex := range hashes {
+				if (sr.err == nil) && (hashIndex >= uint32(len(h.hashes))) {
+					return fmt.Errorf("block %d value %x: bad hash index %d", b, blockValue, hashIndex)
+				}
+			}
+			table[blockValue] = hashes
+		}
+		h.multiIndexTables[b] = table
+	}
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the index: %v", sr.err)
+	}
+
+	count = sr.uint32()
+	if (sr.err == nil) && (count != 0) && (count != blocks) {
+		return fmt.Errorf("expected %d blocks in the order, got %d", blocks, count)
+	}
+	ordered := make([]bool, blocks)
+	for i := uint32(0); (i < count) && (sr.err == nil); i++ {
+		b := sr.uint32()
+		if (sr.err == nil) && ((b >= blocks) || ordered[b]) {
+			return fmt.Errorf("bad block %d in the order", b)
+		}
+		if sr.err == nil {
+			ordered[b] = true
+		}
+		h.blockOrder = append(h.blockOrder, int(b))
+	}
+	if sr.err != nil {
+		return fmt.Errorf("failed to read the order of the blocks: %v", sr.err)
+	}
+
+	// A well framed snapshot can be broken: duplicate hashes, padding bits,
+	// postings which do not match the hashes
+	if err := h.Verify(); err != nil {
+		return fmt.Errorf("broken snapshot: %v", err)
+	}
+	return nil
+}
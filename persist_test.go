@@ -0,0 +1,177 @@
+package hamming
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"sync"
+	"testing"
+)
+
+func TestHammingSaveLoad(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, MaxBucketScan: 1000, ReorderBlocks: true})
+		clusteredDataSet(h, 10, 100, 10, xs)
+		h.Add(h.hashes[7].Dup())
+		h.RemoveBulk([]FuzzyHash{h.hashes[3], h.hashes[500]})
+
+		var buffer bytes.Buffer
+		if err := h.Save(&buffer); err != nil {
+			t.Fatalf("Multiindex %v: failed to save: %v", useMultiindex, err)
+		}
+		snapshot := buffer.Bytes()
+		loaded, err := Load(bytes.NewReader(snapshot))
+		if err != nil {
+			t.Fatalf("Multiindex %v: failed to load: %v", useMultiindex, err)
+		}
+		if err := loaded.Verify(); err != nil {
+			t.Fatalf("Multiindex %v: loaded index is broken: %v", useMultiindex, err)
+		}
+		if (loaded.Count() != h.Count()) || (loaded.Config().MaxBucketScan != 1000) || (loaded.Occurrences(h.hashes[7]) != 2) {
+			t.Errorf("Multiindex %v: expected %d hashes, got %d", useMultiindex, h.Count(), loaded.Count())
+		}
+		for i := 0; i < 100; i++ {
+			query := PerturbHash(h.hashes[10*i], i%40, int64(i))
+			if expected, sibling := h.ShortestDistance(query), loaded.ShortestDistance(query); !sibling.isEqual(expected) {
+				t.Errorf("Multiindex %v: query %d: expected %d, got %d", useMultiindex, i, expected.distance, sibling.distance)
+			}
+		}
+		var again bytes.Buffer
+		loaded.Save(&again)
+		if !bytes.Equal(again.Bytes(), snapshot) {
+			t.Errorf("Multiindex %v: the second snapshot differs", useMultiindex)
+		}
+
+		for n := 0; n < len(snapshot); n += 1 + len(snapshot)/50 {
+			if _, err := Load(bytes.NewReader(snapshot[:n])); err == nil {
+				t.Fatalf("Multiindex %v: expected an error for %d bytes", useMultiindex, n)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	h, _ := New(Config{HashSize: 64, MaxDistance: 3, UseMultiindex: true})
+	h.Save(&buffer)
+	snapshot := buffer.Bytes()
+	snapshot[4] = snapshotVersion + 1
+	if _, err := Load(bytes.NewReader(snapshot)); err == nil {
+		t.Errorf("Expected an error for unsupported version")
+	}
+	snapshot[0] = 'X'
+	if _, err := Load(bytes.NewReader(snapshot)); err == nil {
+		t.Errorf("Expected an error for bad magic")
+	}
+}
+
+func TestHammingLoadInconsistent(t *testing.T) {
+	// 4 blocks of 15 bits and 4 bits of padding
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 60, MaxDistance: 3, UseMultiindex: true, ReorderBlocks: true})
+	hashes := make([]FuzzyHash, 10)
+	for i := range hashes {
+		hashes[i] = FuzzyHash{xs.Uint64() >> 4}
+	}
+	h.AddBulk(hashes)
+	var buffer bytes.Buffer
+	h.Save(&buffer)
+	snapshot := buffer.Bytes()
+	// The words of the hash i follow the live byte
+	hashOffset := func(i int) int {
+		return len(snapshotMagic) + 1 + binary.Size(persistentConfig{}) + 4 + i*9 + 1
+	}
+	putWord := func(blob []byte, offset int, v uint64) {
+		binary.BigEndian.PutUint64(blob[offset:], v)
+	}
+	corruptions := []struct {
+		name    string
+		corrupt func(blob []byte)
+	}{
+		{"duplicate hash", func(blob []byte) { putWord(blob, hashOffset(1), hashes[0][0]) }},
+		{"padding bits", func(blob []byte) { putWord(blob, hashOffset(2), hashes[2][0]|(uint64(1)<<63)) }},
+		{"another block value", func(blob []byte) { putWord(blob, hashOffset(3), hashes[3][0]^0x1) }},
+		{"block order", func(blob []byte) { copy(blob[len(blob)-4:], blob[len(blob)-8:len(blob)-4]) }},
+	}
+	if _, err := Load(bytes.NewReader(snapshot)); err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	for _, corruption := range corruptions {
+		blob := append([]byte(nil), snapshot...)
+		corruption.corrupt(blob)
+		if _, err := Load(bytes.NewReader(blob)); err == nil {
+			t.Errorf("Expected an error for %s", corruption.name)
+		}
+	}
+}
+
+func TestHammingConcurrentSave(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	h.RehashSafe()
+	clusteredDataSet(h, 5, 100, 10, xs)
+	for i := 0; i < 10; i++ {
+		h.Add(h.hashes[i].Dup())
+	}
+	snapshots := make([]bytes.Buffer, 4)
+	var wg sync.WaitGroup
+	for i := range snapshots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := h.Save(&snapshots[i]); err != nil {
+				t.Errorf("Failed to save: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := range snapshots {
+		if !bytes.Equal(snapshots[i].Bytes(), snapshots[0].Bytes()) {
+			t.Errorf("Snapshot %d differs", i)
+		}
+	}
+}
+
+func TestHammingGob(t *testing.T) {
+	type state struct {
+		Name  string
+		Index *H
+	}
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(h, 5, 100, 10, xs)
+	h.RemoveBulk([]FuzzyHash{h.hashes[1]})
+
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(state{Name: "index", Index: h}); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	var decoded state
+	if err := gob.NewDecoder(&buffer).Decode(&decoded); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	index := decoded.Index
+	if (decoded.Name != "index") || (index.Count() != h.Count()) || (index.blocks != h.blocks) || (index.lastBlockSize != h.lastBlockSize) {
+		t.Fatalf("Expected %d hashes, got %d", h.Count(), index.Count())
+	}
+	if err := index.Verify(); err != nil {
+		t.Fatalf("Decoded index is broken: %v", err)
+	}
+	for i, hash := range h.hashes {
+		if (hash != nil) && !index.Contains(hash) {
+			t.Errorf("Hash %d is missing", i)
+		}
+	}
+	if index.Contains(h.hashes[0]) == index.Contains(PerturbHash(h.hashes[0], 1, 0)) {
+		t.Errorf("Expected an exact match only")
+	}
+	if sibling := index.ShortestDistance(PerturbHash(h.hashes[7], 5, 7)); !sibling.isEqual(h.ShortestDistance(PerturbHash(h.hashes[7], 5, 7))) {
+		t.Errorf("Expected the same sibling")
+	}
+	if err := index.GobDecode([]byte("HMNG")); (err == nil) || (index.Count() != 0) {
+		t.Errorf("Expected an error for a broken snapshot")
+	}
+}
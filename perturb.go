@@ -0,0 +1,71 @@
+package hamming
+
+import (
+	"math/rand"
+)
+
+// PerturbHash returns a copy of the hash with exactly 'distance' random bits
+// flipped. The same seed produces the same hash
+// If the distance exceeds the size of the hash I flip all bits. A negative
+// distance is zero distance. I flip any bit of the words, use
+// PerturbHashBits() for a hash with padding bits
+func PerturbHash(base FuzzyHash, distance int, seed int64) FuzzyHash {
+	return PerturbHashBits(base, base.Bits(), distance, seed)
+}
+
+// PerturbHashBits is PerturbHash() for a hash of 'hashSize' bits, see
+// Config.HashSize. I flip the bits below 'hashSize', the padding bits keep
+// their values
+func PerturbHashBits(base FuzzyHash, hashSize, distance int, seed int64) FuzzyHash {
+	if distance < 0 {
+		distance = 0
+	}
+	if (hashSize < 0) || (hashSize > base.Bits()) {
+		hashSize = base.Bits()
+	}
+	fh := base.Dup()
+	random := rand.New(rand.NewSource(seed))
+	bits := random.Perm(hashSize)
+	if distance < len(bits) {
+		bits = bits[:distance]
+	}
+	for _, bit := range bits {
+		fh.FlipBit(bit)
+	}
+	return fh
+}
+
+// PerturbBlock returns a copy of the hash with exactly 'distance' random
+// bits flipped in the block 'block' of the multi-index of 'h'. Without
+// BlockOverlap all other blocks keep their values, overlapping blocks share
+// bits and the flips can change the neighbour blocks. If the distance
+// exceeds the size of the block I flip all bits of the block. A negative
+// distance is zero distance. I return nil if there is no such block
+// The multi-index finds the base hash as long as at least one block is
+// intact. Hashes with one flipped bit in every block are the worst case
+func PerturbBlock(h *H, base FuzzyHash, block, distance int, seed int64) FuzzyHash {
+	if (block < 0) || (block >= h.blocks) || !h.validHash(base) {
+		return nil
+	}
+	if distance < 0 {
+		distance = 0
+	}
+	blockSize := h.blockSize
+	if block == h.blocks-1 {
+		blockSize = h.lastBlockSize
+	}
+	// The padding bits are not in the hash
+	if block*h.blockStep+blockSize > h.config.HashSize {
+		blockSize = h.config.HashSize - block*h.blockStep
+	}
+	fh := base.Dup()
+	random := rand.New(rand.NewSource(seed))
+	bits := random.Perm(blockSize)
+	if distance < len(bits) {
+		bits = bits[:distance]
+	}
+	for _, bit := range bits {
+		fh.FlipBit(block*h.blockStep + bit)
+	}
+	return fh
+}
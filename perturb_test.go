@@ -0,0 +1,106 @@
+package hamming
+
+import (
+	"testing"
+)
+
+func TestPerturbHash(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	base := randomFuzzyHash(256, xs)
+	original := base.Dup()
+	for _, distance := range []int{-1, 0, 1, 7, 35, 64, 255, 256, 300} {
+		for seed := int64(0); seed < 10; seed++ {
+			fh := PerturbHash(base, distance, seed)
+			expected := distance
+			if expected > 256 {
+				expected = 256
+			}
+			if expected < 0 {
+				expected = 0
+			}
+			if hammingDistance := distanceUint64s(base, fh); hammingDistance != expected {
+				t.Errorf("Distance %d seed %d: got %d", distance, seed, hammingDistance)
+			}
+			if !fh.IsEqual(PerturbHash(base, distance, seed)) {
+				t.Errorf("Distance %d seed %d: the result is not reproducible", distance, seed)
+			}
+		}
+	}
+	if !base.IsEqual(original) {
+		t.Errorf("The base hash is modified")
+	}
+
+	// 100 bits and 28 bits of padding
+	base = randomFuzzyHash(128, xs).maskPadding(100)
+	for _, distance := range []int{1, 50, 100, 128} {
+		fh := PerturbHashBits(base, 100, distance, int64(distance))
+		expected := distance
+		if expected > 100 {
+			expected = 100
+		}
+		if d := distanceUint64s(base, fh); (d != expected) || fh.hasPadding(100) {
+			t.Errorf("Distance %d: got distance %d, padding %v", distance, d, fh.hasPadding(100))
+		}
+	}
+}
+
+func TestPerturbBlock(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	// 36 blocks of 7 bits, the last block is 11 bits
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	base := randomFuzzyHash(256, xs)
+	h.Add(base)
+	for i := 0; i < 100; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	for block := 0; block < h.blocks; block++ {
+		for _, distance := range []int{-1, 0, 1, 7, 11} {
+			fh := PerturbBlock(h, base, block, distance, int64(block))
+			expected := distance
+			if (block < h.blocks-1) && (expected > h.blockSize) {
+				expected = h.blockSize
+			}
+			if expected < 0 {
+				expected = 0
+			}
+			var hashBuffer, fhBuffer [256]uint16
+			hashBlockValues, fhBlockValues := h.blockValues(base, hashBuffer[:0]), h.blockValues(fh, fhBuffer[:0])
+			for b := range hashBlockValues {
+				if (b != block) && (hashBlockValues[b] != fhBlockValues[b]) {
+					t.Fatalf("Block %d: block %d is modified", block, b)
+				}
+			}
+			// One block differs, other blocks match
+			sibling := h.ShortestDistance(fh)
+			if (sibling.distance != expected) || !sibling.s.IsEqual(base) {
+				t.Errorf("Block %d distance %d: got distance %d, hash %s", block, distance, sibling.distance, sibling.s.ToString())
+			}
+		}
+	}
+	if fh := PerturbBlock(h, base, h.blocks, 1, 1); fh != nil {
+		t.Errorf("Expected nil for a block out of range, got %s", fh.ToString())
+	}
+
+	// The last block ends below the padding bits
+	h, _ = New(Config{HashSize: 100, MaxDistance: 9, UseMultiindex: true})
+	base = randomFuzzyHash(128, xs).maskPadding(100)
+	fh := PerturbBlock(h, base, h.blocks-1, 128, 1)
+	if d := distanceUint64s(base, fh); (d != h.lastBlockSize) || fh.hasPadding(100) {
+		t.Errorf("Expected distance %d, got distance %d, padding %v", h.lastBlockSize, d, fh.hasPadding(100))
+	}
+
+	// MaxDistance 0 means one block. A flipped bit in the block hides the
+	// hash from the multi-index. The brute force finds the hash
+	h, _ = New(Config{HashSize: 16, MaxDistance: 0, UseMultiindex: true})
+	base = FuzzyHash{0x1234}
+	h.Add(base)
+	fh = PerturbBlock(h, base, 0, 1, 1)
+	if sibling := h.ShortestDistance(fh); sibling.s != nil {
+		t.Errorf("Expected the multi-index to miss, got distance %d", sibling.distance)
+	}
+	if sibling := h.shortestDistanceBruteForce(fh); sibling.distance != 1 {
+		t.Errorf("Expected distance 1, got %d", sibling.distance)
+	}
+}
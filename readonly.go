@@ -0,0 +1,40 @@
+package hamming
+
+// ReadOnlyH is a view of H which only answers queries. The view shares the
+// tables with H. Hand the view to the request handlers and keep H for the
+// updates. See the clone-and-swap pattern in the package documentation
+// Many threads can call ReadOnlyH APIs simultaneously as long as nobody
+// modifies the H
+type ReadOnlyH struct {
+	h *H
+}
+
+// ReadOnly returns a read only view of the DB. I do not copy the tables
+func (h *H) ReadOnly() *ReadOnlyH {
+	return &ReadOnlyH{h: h}
+}
+
+// ShortestDistance returns the closest sibling, see H.ShortestDistance()
+func (ro *ReadOnlyH) ShortestDistance(hash FuzzyHash) Sibling {
+	return ro.h.ShortestDistance(hash)
+}
+
+// Within returns all siblings within the distance d, see H.Within()
+func (ro *ReadOnlyH) Within(hash FuzzyHash, d int) []Sibling {
+	return ro.h.Within(hash, d)
+}
+
+// KNearest returns up to k closest siblings sorted by distance
+func (ro *ReadOnlyH) KNearest(hash FuzzyHash, k int) []Sibling {
+	return ro.h.KNearest(hash, k)
+}
+
+// Contains returns true if the hash is in the DB
+func (ro *ReadOnlyH) Contains(hash FuzzyHash) bool {
+	return ro.h.Contains(hash)
+}
+
+// Count returns the number of hashes in the DB
+func (ro *ReadOnlyH) Count() int {
+	return ro.h.Count()
+}
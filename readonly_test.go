@@ -0,0 +1,44 @@
+package hamming
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHammingReadOnly(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	clusteredDataSet(h, 10, 100, 10, xs)
+	ro := h.ReadOnly()
+	if ro.Count() != h.Count() {
+		t.Errorf("Expected %d hashes, got %d", h.Count(), ro.Count())
+	}
+	for i := 0; i < 100; i++ {
+		query := PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], i%20, int64(i))
+		if sibling, expected := ro.ShortestDistance(query), h.ShortestDistance(query); !sibling.isEqual(expected) {
+			t.Errorf("Query %d: expected %v, got %v", i, expected, sibling)
+		}
+		if ro.Contains(query) != h.Contains(query) {
+			t.Errorf("Query %d: expected contains %v", i, h.Contains(query))
+		}
+		siblings, expected := ro.KNearest(query, 3), h.KNearest(query, 3)
+		if !reflect.DeepEqual(siblings, expected) {
+			t.Errorf("Query %d: expected %v, got %v", i, expected, siblings)
+		}
+		if siblings, expected := ro.Within(query, 10), h.Within(query, 10); !reflect.DeepEqual(siblings, expected) {
+			t.Errorf("Query %d: expected %v, got %v", i, expected, siblings)
+		}
+	}
+
+	roType := reflect.TypeOf(ro)
+	for i := 0; i < roType.NumMethod(); i++ {
+		name := roType.Method(i).Name
+		for _, prefix := range []string{"Add", "Remove", "Rebuild", "Compact"} {
+			if strings.HasPrefix(name, prefix) {
+				t.Errorf("Unexpected mutation method %s", name)
+			}
+		}
+	}
+}
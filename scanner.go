@@ -0,0 +1,199 @@
+package hamming
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// HashScanner reads hashes from a text stream, one hash string per line
+// I skip empty lines. The API is similar to bufio.Scanner: call Scan()
+// until it returns false, then check Err()
+type HashScanner struct {
+	scanner    *bufio.Scanner
+	lineNumber int
+	hash       FuzzyHash
+	err        error
+
+	// normalize is applied to every line before parsing, see Config.Normalizer
+	normalize func(string) string
+}
+
+// NewHashScanner returns a scanner reading from r
+func NewHashScanner(r io.Reader) *HashScanner {
+	return &HashScanner{scanner: bufio.NewScanner(r)}
+}
+
+// Scan reads the next hash. Scan returns false in the end of the stream
+// or after an error
+func (s *HashScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	for s.scanner.Scan() {
+		s.lineNumber++
+		line := strings.TrimSpace(s.scanner.Text())
+		if s.normalize != nil {
+			line = s.normalize(line)
+		}
+		if line == "" {
+			continue
+		}
+		fh, err := HashStringToFuzzyHash(line)
+		if err != nil {
+			s.err = fmt.Errorf("line %d: %v", s.lineNumber, err)
+			return false
+		}
+		s.hash = fh
+		return true
+	}
+	s.err = s.scanner.Err()
+	return false
+}
+
+// Hash returns the hash read by the last call to Scan()
+func (s *HashScanner) Hash() FuzzyHash {
+	return s.hash
+}
+
+// LineNumber returns the line of the last hash
+func (s *HashScanner) LineNumber() int {
+	return s.lineNumber
+}
+
+// Err returns the first error
+func (s *HashScanner) Err() error {
+	return s.err
+}
+
+// HashStringToFuzzyHashReader reads hashes from a text stream, one hash
+// string per line. I skip empty lines
+// Wrap a compressed file with gzip.NewReader() to load the hashes without
+// decompressing the file to the disk
+func HashStringToFuzzyHashReader(r io.Reader) ([]FuzzyHash, error) {
+	var hashes []FuzzyHash
+	scanner := NewHashScanner(r)
+	for scanner.Scan() {
+		hashes = append(hashes, scanner.Hash())
+	}
+	return hashes, scanner.Err()
+}
+
+// AddFromScanner adds the hashes from the scanner to the DB as the scanner
+// reads them. I return the number of new hashes in the DB and the first
+// error. A hash of a wrong size is an error
+// The scanner applies Config.Normalizer to the lines, I restore the
+// normalizer of the scanner before returning
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) AddFromScanner(s *HashScanner) (int, error) {
+	defer func(normalize func(string) string) { s.normalize = normalize }(s.normalize)
+	s.normalize = h.config.Normalizer
+	added := 0
+	for s.Scan() {
+		hash := s.Hash()
+		if !h.validHash(hash) {
+			return added, fmt.Errorf("line %d: hash %s is not %d bits", s.LineNumber(), hash.ToString(), h.config.HashSize)
+		}
+		if h.Add(hash) {
+			added++
+		}
+	}
+	return added, s.Err()
+}
+
+// LoadCSV reads the hash strings, one hash per line, and adds the hashes
+// to the DB like AddBulk() does. I skip empty lines. The DB shall be
+// configured for the size of the hashes in the file. I return the number
+// of new hashes in the DB and the first error with the line number
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) LoadCSV(r io.Reader) (int, error) {
+	return h.AddFromScanner(NewHashScanner(r))
+}
+
+// WriteCSV writes the hashes in the order of insertion, one hash string
+// per line, upper case hex digits. A hash added N times appears N times
+// LoadCSV() reads the output and restores the same hashes and occurrences
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) WriteCSV(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	line := make([]byte, 0, 16*h.config.words()+1)
+	var err error
+	h.forEachHash(func(hash FuzzyHash) {
+		line = hash.AppendHex(line[:0])
+		for i, c := range line {
+			if c >= 'a' {
+				line[i] = c - 'a' + 'A'
+			}
+		}
+		line = append(line, '\n')
+		for i := 0; (i < 1+int(h.duplicates[hash.toKey()])) && (err == nil); i++ {
+			_, err = writer.Write(line)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// NewFromHex creates a DB and adds the hash strings. I apply
+// Config.Normalizer to every string before parsing and order the blocks,
+// see H.ReorderBlocks()
+// I return an error if a string is not a hash of the configured size
+func NewFromHex(config Config, hashes []string) (*H, error) {
+	h, err := New(config)
+	if err != nil {
+		return h, err
+	}
+	defer h.ReorderBlocks()
+	for i, hash := range hashes {
+		if config.Normalizer != nil {
+			hash = config.Normalizer(hash)
+		}
+		fh, err := HashStringToFuzzyHash(hash)
+		if err != nil {
+			return h, fmt.Errorf("hash %d: %v", i, err)
+		}
+		if !h.validHash(fh) {
+			return h, fmt.Errorf("hash %d: hash %s is not %d bits", i, fh.ToString(), config.HashSize)
+		}
+		h.Add(fh)
+	}
+	return h, nil
+}
+
+// ValidateHashFile reads the hash strings, one hash per line, and checks
+// that every line is a hash of the expected size. I do not build an index
+// I return the number of lines and an error for every bad line
+// Check a large file before loading it
+func ValidateHashFile(r io.Reader, expectedBits int) (lines int, errs []error) {
+	words := (expectedBits + 63) / 64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fh, err := HashStringToFuzzyHash(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", lines, err))
+			continue
+		}
+		if len(fh) != words {
+			errs = append(errs, fmt.Errorf("line %d: hash is %d bits, expected %d bits", lines, fh.Bits(), expectedBits))
+			continue
+		}
+		if fh.hasPadding(expectedBits) {
+			errs = append(errs, fmt.Errorf("line %d: hash %s is larger than %d bits", lines, line, expectedBits))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("line %d: %v", lines+1, err))
+	}
+	return lines, errs
+}
@@ -0,0 +1,214 @@
+package hamming
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHashStringToFuzzyHashReader(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fmt.Fprintf(writer, "%s\r\n", hash)
+	}
+	fmt.Fprintf(writer, "\n%s\n", allFsHash)
+	writer.Close()
+
+	reader, err := gzip.NewReader(&compressed)
+	if err != nil {
+		t.Fatalf("Failed to open the stream: %v", err)
+	}
+	hashes, err := HashStringToFuzzyHashReader(reader)
+	if err != nil {
+		t.Fatalf("Failed to load the hashes: %v", err)
+	}
+	expected := append(hammingDistanceTests[0].hashes, allFsHash)
+	if len(hashes) != len(expected) {
+		t.Fatalf("Expected %d hashes, got %d", len(expected), len(hashes))
+	}
+	for i, hash := range expected {
+		if fh, _ := HashStringToFuzzyHash(hash); !fh.IsEqual(hashes[i]) {
+			t.Errorf("Expected %s, got %s", hash, hashes[i].ToString())
+		}
+	}
+
+	_, err = HashStringToFuzzyHashReader(strings.NewReader(allFsHash + "\n0123\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error in line 2, got %v", err)
+	}
+}
+
+func TestHammingAddFromScanner(t *testing.T) {
+	var file bytes.Buffer
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fmt.Fprintf(&file, "%s\n", hash)
+	}
+	fmt.Fprintf(&file, "%s\n\n", hammingDistanceTests[0].hashes[1])
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	added, err := h.AddFromScanner(NewHashScanner(&file))
+	if err != nil || added != len(hammingDistanceTests[0].hashes) {
+		t.Fatalf("Expected %d hashes, got %d %v", len(hammingDistanceTests[0].hashes), added, err)
+	}
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		if !h.Contains(fh) {
+			t.Errorf("Hash %s is missing", hash)
+		}
+	}
+	fh, _ := HashStringToFuzzyHash(hammingDistanceTests[0].hashes[1])
+	if occurrences := h.Occurrences(fh); occurrences != 2 {
+		t.Errorf("Expected 2 occurrences, got %d", occurrences)
+	}
+
+	// A 128 bits hash in line 3
+	file.Reset()
+	fmt.Fprintf(&file, "%s\n\n%s\n%s\n", allFsHash, allZerosHash[:32], allZerosHash)
+	h, _ = New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	added, err = h.AddFromScanner(NewHashScanner(&file))
+	if err == nil || !strings.Contains(err.Error(), "line 3") || (added != 1) {
+		t.Errorf("Expected an error in line 3 and one hash, got %d %v", added, err)
+	}
+}
+
+func TestHammingLoadCSV(t *testing.T) {
+	for _, useMultiindex := range []bool{true, false} {
+		xs := &XorShift1024Star{}
+		xs.Init()
+		var file bytes.Buffer
+		hashes := make([]FuzzyHash, 100)
+		for i := range hashes {
+			hashes[i] = randomFuzzyHash(256, xs)
+			fmt.Fprintf(&file, "%s\n", hashes[i].ToString())
+			if i%10 == 0 {
+				fmt.Fprintf(&file, "\n")
+			}
+		}
+		h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: useMultiindex, ReorderBlocks: true})
+		added, err := h.LoadCSV(&file)
+		if (err != nil) || (added != len(hashes)) || (h.Count() != len(hashes)) {
+			t.Fatalf("Multiindex %v: expected %d hashes, got %d %v", useMultiindex, len(hashes), added, err)
+		}
+		for i, hash := range hashes {
+			if !h.Contains(hash) {
+				t.Errorf("Multiindex %v: hash %d is missing", useMultiindex, i)
+			}
+		}
+		// LoadCSV() adds the hashes like AddBulk() and does not reorder
+		if h.blockOrder != nil {
+			t.Errorf("Multiindex %v: unexpected block order %v", useMultiindex, h.blockOrder)
+		}
+	}
+
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	added, err := h.LoadCSV(strings.NewReader(allFsHash + "\n\n" + allZerosHash + "\nXYZ\n" + allFsHash + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 4") || (added != 2) {
+		t.Errorf("Expected an error in line 4 and two hashes, got %d %v", added, err)
+	}
+}
+
+func TestHammingWriteCSV(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	var file bytes.Buffer
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&file, "%s\n", randomFuzzyHash(256, xs).ToString())
+	}
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	h.LoadCSV(&file)
+	h.Add(h.hashes[4].Dup())
+	h.RemoveBulk([]FuzzyHash{h.hashes[7]})
+
+	var dump bytes.Buffer
+	if err := h.WriteCSV(&dump); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(dump.String(), "\n"), "\n")
+	if (len(lines) != 100) || (lines[0] != strings.ToUpper(h.hashes[0].ToString())) {
+		t.Fatalf("Expected 100 upper case lines, got %d %q", len(lines), lines[0])
+	}
+	reloaded, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: false})
+	if added, err := reloaded.LoadCSV(&dump); (err != nil) || (added != h.Count()) || (reloaded.Count() != h.Count()) {
+		t.Fatalf("Expected %d hashes, got %d %v", h.Count(), added, err)
+	}
+	for i, hash := range h.hashes {
+		if (hash != nil) && !reloaded.Contains(hash) {
+			t.Errorf("Hash %d is missing", i)
+		}
+	}
+	if reloaded.Contains(PerturbHash(h.hashes[0], 1, 0)) {
+		t.Errorf("Unexpected hash")
+	}
+	if reloaded.Occurrences(h.hashes[4]) != 2 {
+		t.Errorf("Expected 2 occurrences, got %d", reloaded.Occurrences(h.hashes[4]))
+	}
+	if added, removed, _ := Diff(h, reloaded); (len(added) != 0) || (len(removed) != 0) {
+		t.Errorf("Expected no difference, got %v, %v", added, removed)
+	}
+}
+
+func TestHammingNormalizer(t *testing.T) {
+	stripPrefix := func(s string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	}
+	config := Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, ReorderBlocks: true, Normalizer: stripPrefix}
+	var prefixed []string
+	for i, hash := range hammingDistanceTests[0].hashes {
+		prefix := []string{"0x", "0X", ""}[i%3]
+		prefixed = append(prefixed, prefix+hash)
+	}
+
+	h, err := NewFromHex(config, prefixed)
+	if err != nil {
+		t.Fatalf("Failed to load the hashes: %v", err)
+	}
+	scanned, _ := New(config)
+	scanner := NewHashScanner(strings.NewReader(strings.Join(prefixed, "\n")))
+	if _, err := scanned.AddFromScanner(scanner); err != nil {
+		t.Fatalf("Failed to scan the hashes: %v", err)
+	}
+	if scanner.normalize != nil {
+		t.Errorf("The normalizer of the scanner is modified")
+	}
+	for i, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		if !h.hashes[i].IsEqual(fh) || !scanned.hashes[i].IsEqual(fh) {
+			t.Errorf("Hash %d: expected %s, got %s and %s", i, hash, h.hashes[i].ToString(), scanned.hashes[i].ToString())
+		}
+	}
+	// NewFromHex() creates the DB and orders the blocks once
+	if (len(h.blockOrder) != h.blocks) || (scanned.blockOrder != nil) {
+		t.Errorf("Expected the block order only in the new DB, got %v and %v", h.blockOrder, scanned.blockOrder)
+	}
+
+	config.Normalizer = nil
+	if _, err := NewFromHex(config, prefixed); err == nil {
+		t.Errorf("Expected an error without the normalizer")
+	}
+	if _, err := NewFromHex(config, []string{"1122334455667788"}); err == nil {
+		t.Errorf("Expected an error for a short hash")
+	}
+}
+
+func TestValidateHashFile(t *testing.T) {
+	file := allFsHash + "\n" + "0123456789abcdefXX23456789abcdef0123456789abcdef0123456789abcdef" + "\n\n"
+	lines, errs := ValidateHashFile(strings.NewReader(file), 256)
+	if lines != 3 {
+		t.Errorf("Expected 3 lines, got %d", lines)
+	}
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "line 2") {
+		t.Errorf("Expected an error in line 2, got %v", errs)
+	}
+
+	file = allZerosHash[:32] + "\n" + allFsHash + "\n" + allZerosHash + "\n"
+	lines, errs = ValidateHashFile(strings.NewReader(file), 200)
+	if lines != 3 || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors in 3 lines, got %d %v", lines, errs)
+	}
+	// 128 bits hash, non zero padding
+	if !strings.Contains(errs[0].Error(), "line 1") || !strings.Contains(errs[1].Error(), "line 2") {
+		t.Errorf("Expected errors in lines 1 and 2, got %v", errs)
+	}
+}
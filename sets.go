@@ -0,0 +1,53 @@
+package hamming
+
+import (
+	"fmt"
+)
+
+// Diff returns hashes which are in the newH and not in the oldH (added)
+// and hashes which are in the oldH and not in the newH (removed)
+// The order of insertion does not matter. I compare the stored hashes, the
+// only incompatible configurations are different hash sizes. The DBs can
+// differ in MaxDistance, UseMultiindex, BlockOverlap and other settings
+// of the lookup
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func Diff(oldH, newH *H) (added, removed []FuzzyHash, err error) {
+	if oldH.config.HashSize != newH.config.HashSize {
+		return nil, nil, fmt.Errorf("hash size %d is not equal %d", oldH.config.HashSize, newH.config.HashSize)
+	}
+	newH.forEachHash(func(hash FuzzyHash) {
+		if !oldH.Contains(hash) {
+			added = append(added, hash)
+		}
+	})
+	oldH.forEachHash(func(hash FuzzyHash) {
+		if !newH.Contains(hash) {
+			removed = append(removed, hash)
+		}
+	})
+	return added, removed, nil
+}
+
+// SetOps returns the number of distinct hashes in the union and in the
+// intersection of the DBs. I do not build the sets, I look up the hashes
+// of the smaller DB in the larger DB. Jaccard index is
+// intersection/union. Like Diff() I return an error only for different
+// hash sizes, the settings of the lookup do not change the sets
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func SetOps(a, b *H) (union, intersection int, err error) {
+	if a.config.HashSize != b.config.HashSize {
+		return 0, 0, fmt.Errorf("hash size %d is not equal %d", a.config.HashSize, b.config.HashSize)
+	}
+	small, large := a, b
+	if small.Count() > large.Count() {
+		small, large = large, small
+	}
+	small.forEachHash(func(hash FuzzyHash) {
+		if large.Contains(hash) {
+			intersection++
+		}
+	})
+	return a.Count() + b.Count() - intersection, intersection, nil
+}
@@ -0,0 +1,71 @@
+package hamming
+
+import (
+	"testing"
+)
+
+func TestHammingDiff(t *testing.T) {
+	var hashes []FuzzyHash
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		hashes = append(hashes, fh)
+	}
+	oldH, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	oldH.AddBulk(hashes[:5])
+	// A different layout of the index does not matter
+	newH, _ := New(Config{HashSize: 256, MaxDistance: 15, UseMultiindex: false})
+	newH.AddBulk(hashes[2:])
+
+	added, removed, err := Diff(oldH, newH)
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	if len(added) != 2 || !added[0].IsEqual(hashes[5]) || !added[1].IsEqual(hashes[6]) {
+		t.Errorf("Expected added hashes 5 and 6, got %v", added)
+	}
+	if len(removed) != 2 || !removed[0].IsEqual(hashes[0]) || !removed[1].IsEqual(hashes[1]) {
+		t.Errorf("Expected removed hashes 0 and 1, got %v", removed)
+	}
+
+	added, removed, _ = Diff(oldH, oldH.Dup())
+	if len(added) != 0 || len(removed) != 0 {
+		t.Errorf("Expected no difference, got %v, %v", added, removed)
+	}
+
+	otherH, _ := New(Config{HashSize: 128, MaxDistance: 15, UseMultiindex: true})
+	if _, _, err := Diff(oldH, otherH); err == nil {
+		t.Errorf("Expected an error for different hash sizes")
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	xs := &XorShift1024Star{}
+	xs.Init()
+	hashes := make([]FuzzyHash, 10)
+	for i := range hashes {
+		hashes[i] = randomFuzzyHash(256, xs)
+	}
+	a, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	a.AddBulk(hashes[:6])
+	a.Add(hashes[0].Dup())
+	b, _ := New(Config{HashSize: 256, MaxDistance: 15, UseMultiindex: false})
+	b.AddBulk(hashes[3:])
+	b.RemoveBulk([]FuzzyHash{hashes[9]})
+
+	// a keeps 0-5, b keeps 3-8
+	for _, pair := range [][2]*H{{a, b}, {b, a}} {
+		union, intersection, err := SetOps(pair[0], pair[1])
+		if (err != nil) || (union != 9) || (intersection != 3) {
+			t.Errorf("Expected union 9 and intersection 3, got %d %d %v", union, intersection, err)
+		}
+	}
+	empty, _ := New(Config{HashSize: 256, MaxDistance: 35})
+	if union, intersection, _ := SetOps(a, empty); (union != 6) || (intersection != 0) {
+		t.Errorf("Expected union 6 and intersection 0, got %d %d", union, intersection)
+	}
+
+	otherH, _ := New(Config{HashSize: 128, MaxDistance: 15, UseMultiindex: true})
+	if _, _, err := SetOps(a, otherH); err == nil {
+		t.Errorf("Expected an error for different hash sizes")
+	}
+}
@@ -0,0 +1,205 @@
+package hamming
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// persistentConfig keeps the fields of Config which I can store in a file
+// The callbacks and the debug output are not stored. All fields are of
+// fixed size, Save() writes the structure as is
+type persistentConfig struct {
+	HashSize           int64
+	MaxDistance        int64
+	UseMultiindex      bool
+	BlockOverlap       int64
+	PopcountMode       int64
+	MaxCandidates      int64
+	ExpectedCount      int64
+	SlowQueryThreshold int64
+	RandomizeTies      bool
+	TiesSeed           int64
+	MaxBucketScan      int64
+	ReorderBlocks      bool
+	AtomicStats        bool
+}
+
+func newPersistentConfig(config Config) persistentConfig {
+	return persistentConfig{
+		HashSize:           int64(config.HashSize),
+		MaxDistance:        int64(config.MaxDistance),
+		UseMultiindex:      config.UseMultiindex,
+		BlockOverlap:       int64(config.BlockOverlap),
+		PopcountMode:       int64(config.PopcountMode),
+		MaxCandidates:      int64(config.MaxCandidates),
+		ExpectedCount:      int64(config.ExpectedCount),
+		SlowQueryThreshold: int64(config.SlowQueryThreshold),
+		RandomizeTies:      config.RandomizeTies,
+		TiesSeed:           config.TiesSeed,
+		MaxBucketScan:      int64(config.MaxBucketScan),
+		ReorderBlocks:      config.ReorderBlocks,
+		AtomicStats:        config.AtomicStats,
+	}
+}
+
+func (pc persistentConfig) config() Config {
+	return Config{
+		HashSize:           int(pc.HashSize),
+		MaxDistance:        int(pc.MaxDistance),
+		UseMultiindex:      pc.UseMultiindex,
+		BlockOverlap:       int(pc.BlockOverlap),
+		PopcountMode:       PopcountMode(pc.PopcountMode),
+		MaxCandidates:      int(pc.MaxCandidates),
+		ExpectedCount:      int(pc.ExpectedCount),
+		SlowQueryThreshold: int(pc.SlowQueryThreshold),
+		RandomizeTies:      pc.RandomizeTies,
+		TiesSeed:           pc.TiesSeed,
+		MaxBucketScan:      int(pc.MaxBucketScan),
+		ReorderBlocks:      pc.ReorderBlocks,
+		AtomicStats:        pc.AtomicStats,
+	}
+}
+
+// The manifest of the sharded snapshot
+const shardsManifest = "manifest.json"
+
+// The largest number of shards. A broken manifest does not allocate all
+// memory
+const maxShards = 1 << 16
+
+type shardedManifest struct {
+	Shards int
+	Config persistentConfig
+}
+
+func shardFilename(dir string, shard int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%04d.txt", shard))
+}
+
+// SaveSharded writes the DB to 'shards' files in the directory, one hash
+// string per line, and a manifest with the configuration. The value of the
+// first block picks the shard. A hash added N times appears in the shard N
+// times. LoadSharded() reads the files in parallel
+// This API is not reentrant and should not be called simultaneously
+// with add/remove
+func (h *H) SaveSharded(dir string, shards int) error {
+	if shards <= 0 {
+		return fmt.Errorf("number of shards is not positive %d", shards)
+	}
+	if shards > maxShards {
+		return fmt.Errorf("number of shards %d exceeds %d", shards, maxShards)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := make([]*os.File, shards)
+	writers := make([]*bufio.Writer, shards)
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+	for shard := range files {
+		f, err := os.Create(shardFilename(dir, shard))
+		if err != nil {
+			return err
+		}
+		files[shard], writers[shard] = f, bufio.NewWriter(f)
+	}
+
+	line := make([]byte, 0, 16*h.config.words()+1)
+	var err error
+	h.forEachHash(func(hash FuzzyHash) {
+		writer := writers[int(h.blockValue(hash, 0))%shards]
+		line = append(hash.AppendHex(line[:0]), '\n')
+		for i := 0; i < 1+int(h.duplicates[hash.toKey()]); i++ {
+			if _, writeErr := writer.Write(line); (writeErr != nil) && (err == nil) {
+				err = writeErr
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for shard, writer := range writers {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if err := files[shard].Close(); err != nil {
+			return err
+		}
+		files[shard] = nil
+	}
+
+	manifest, err := json.Marshal(shardedManifest{Shards: shards, Config: newPersistentConfig(h.config)})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, shardsManifest), manifest, 0644)
+}
+
+// LoadSharded reads the DB written by SaveSharded(). I parse the shards
+// in parallel and add the hashes shard by shard. I order the blocks once
+// after the last shard, see H.ReorderBlocks(). The order of insertion is
+// not preserved
+func LoadSharded(dir string) (*H, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, shardsManifest))
+	if err != nil {
+		return nil, err
+	}
+	var manifest shardedManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest: %v", err)
+	}
+	if manifest.Shards <= 0 {
+		return nil, fmt.Errorf("number of shards is not positive %d", manifest.Shards)
+	}
+	if manifest.Shards > maxShards {
+		return nil, fmt.Errorf("number of shards %d exceeds %d", manifest.Shards, maxShards)
+	}
+	h, err := New(manifest.Config.config())
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]FuzzyHash, manifest.Shards)
+	errs := make([]error, manifest.Shards)
+	var wg sync.WaitGroup
+	for shard := range hashes {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			f, err := os.Open(shardFilename(dir, shard))
+			if err != nil {
+				errs[shard] = err
+				return
+			}
+			defer f.Close()
+			hashes[shard], errs[shard] = HashStringToFuzzyHashReader(f)
+		}(shard)
+	}
+	wg.Wait()
+
+	for shard := range hashes {
+		if errs[shard] != nil {
+			return nil, fmt.Errorf("shard %d: %v", shard, errs[shard])
+		}
+		for _, hash := range hashes[shard] {
+			if !h.validHash(hash) {
+				return nil, fmt.Errorf("shard %d: hash %s is not %d bits", shard, hash.ToString(), h.config.HashSize)
+			}
+		}
+		for _, hash := range hashes[shard] {
+			h.Add(hash)
+		}
+	}
+	h.ReorderBlocks()
+	return h, nil
+}
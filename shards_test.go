@@ -0,0 +1,65 @@
+package hamming
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHammingSaveSharded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hamming")
+	if err != nil {
+		t.Fatalf("Failed to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	xs := &XorShift1024Star{}
+	xs.Init()
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true, MaxBucketScan: 1000, ReorderBlocks: true})
+	clusteredDataSet(h, 10, 100, 10, xs)
+	h.Add(h.hashes[5].Dup())
+	if err := h.SaveSharded(dir, 4); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	loaded, err := LoadSharded(dir)
+	if err != nil {
+		t.Fatalf("Failed to load: %v", err)
+	}
+	if loaded.Count() != h.Count() || loaded.Config().MaxBucketScan != 1000 {
+		t.Fatalf("Expected %d hashes, got %d", h.Count(), loaded.Count())
+	}
+	if err := loaded.Verify(); err != nil {
+		t.Fatalf("Loaded index is broken: %v", err)
+	}
+	if len(loaded.blockOrder) != loaded.blocks {
+		t.Errorf("Expected the block order, got %v", loaded.blockOrder)
+	}
+	if loaded.Occurrences(h.hashes[5]) != 2 {
+		t.Errorf("Expected 2 occurrences, got %d", loaded.Occurrences(h.hashes[5]))
+	}
+	for i := 0; i < 100; i++ {
+		query := PerturbHash(h.hashes[xs.Uint64()%uint64(len(h.hashes))], i%30, int64(i))
+		if sibling, expected := loaded.ShortestDistance(query), h.ShortestDistance(query); sibling.distance != expected.distance {
+			t.Errorf("Query %d: expected distance %d, got %d", i, expected.distance, sibling.distance)
+		}
+	}
+
+	if err := h.SaveSharded(dir, 0); err == nil {
+		t.Errorf("Expected an error for zero shards")
+	}
+	os.Remove(shardFilename(dir, 3))
+	if _, err := LoadSharded(dir); err == nil {
+		t.Errorf("Expected an error for a missing shard")
+	}
+	for _, shards := range []int{0, -1, maxShards + 1, 1 << 40} {
+		manifest := fmt.Sprintf(`{"Shards": %d}`, shards)
+		if err := ioutil.WriteFile(filepath.Join(dir, shardsManifest), []byte(manifest), 0644); err != nil {
+			t.Fatalf("Failed to write the manifest: %v", err)
+		}
+		if _, err := LoadSharded(dir); err == nil {
+			t.Errorf("Expected an error for %d shards", shards)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package hamming
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Write ahead log records
+// A record is one byte of operation followed by the words of the hash,
+// the most significant byte first. All records of a log are of the
+// same size. The words of a clear record are zero
+const (
+	walOpAdd    = byte('A')
+	walOpRemove = byte('R')
+	walOpClear  = byte('C')
+)
+
+// AttachWAL starts logging of all modifications of the DB to the writer
+// Every add of a valid hash, including an add of a hash which is already
+// in the DB, every successful remove and RemoveAll() append a record.
+// ReplayWAL() restores the DB from the log. Dup() passes the log to the
+// clone, the application modifies the clone. The original and the clone
+// write to the same writer, modify only one of them
+// I do not flush or sync the writer. Use WALError() to check for write errors
+// This API is not reentrant and should not be called simultaneously
+// with add/remove/dup/distance
+func (h *H) AttachWAL(w io.Writer) {
+	h.wal = w
+	h.walErr = nil
+	h.walRecord = make([]byte, 1+8*h.config.words())
+}
+
+// WALError returns the first error writing the log. I stop logging after
+// an error
+func (h *H) WALError() error {
+	return h.walErr
+}
+
+func (h *H) appendWAL(op byte, hash FuzzyHash) {
+	if h.wal == nil || h.walErr != nil {
+		return
+	}
+	h.walRecord[0] = op
+	for i := 0; 1+8*i < len(h.walRecord); i++ {
+		v := uint64(0)
+		if i < len(hash) {
+			v = hash[i]
+		}
+		binary.BigEndian.PutUint64(h.walRecord[1+8*i:], v)
+	}
+	_, h.walErr = h.wal.Write(h.walRecord)
+}
+
+// ReplayWAL creates a new DB and applies all records from the log
+// A crash in the middle of a write leaves an incomplete record at the end
+// of the log. ReplayWAL ignores the incomplete record
+func ReplayWAL(config Config, r io.Reader) (*H, error) {
+	h, err := New(config)
+	if err != nil {
+		return h, err
+	}
+	record := make([]byte, 1+8*config.words())
+	for recordIndex := 0; ; recordIndex++ {
+		_, err := io.ReadFull(r, record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return h, nil
+		}
+		if err != nil {
+			return h, fmt.Errorf("failed to read record %d: %v", recordIndex, err)
+		}
+		hash := make(FuzzyHash, config.words())
+		for i := range hash {
+			hash[i] = binary.BigEndian.Uint64(record[1+8*i:])
+		}
+		switch record[0] {
+		case walOpAdd:
+			h.Add(hash)
+		case walOpRemove:
+			h.remove(hash)
+		case walOpClear:
+			h.RemoveAll()
+		default:
+			return h, fmt.Errorf("bad operation %x in record %d", record[0], recordIndex)
+		}
+	}
+}
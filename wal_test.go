@@ -0,0 +1,113 @@
+package hamming
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHammingReplayWAL(t *testing.T) {
+	config := Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true}
+	h, _ := New(config)
+	var wal bytes.Buffer
+	h.AttachWAL(&wal)
+
+	var hashes []FuzzyHash
+	for _, hash := range hammingDistanceTests[0].hashes {
+		fh, _ := HashStringToFuzzyHash(hash)
+		hashes = append(hashes, fh)
+	}
+	h.AddBulk(hashes)
+	h.Add(hashes[0]) // the log keeps the number of occurrences
+	// I remove the last hash
+	h.RemoveBulk(hashes[len(hashes)-1:])
+	h = h.Dup()
+	fh, _ := HashStringToFuzzyHash(allFsHash)
+	h.Add(fh)
+	if err := h.WALError(); err != nil {
+		t.Fatalf("Failed to write the log: %v", err)
+	}
+	if wal.Len() != (len(hashes)+3)*33 {
+		t.Errorf("Expected %d records, got %d bytes", len(hashes)+3, wal.Len())
+	}
+
+	// An incomplete record in the end of the log
+	wal.Write([]byte{walOpAdd, 0x00, 0x01})
+	replayed, err := ReplayWAL(config, &wal)
+	if err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	if len(replayed.hashesLookup) != len(h.hashesLookup) {
+		t.Errorf("Expected %d hashes, got %d", len(h.hashesLookup), len(replayed.hashesLookup))
+	}
+	for _, hash := range append(hashes, fh) {
+		if replayed.Contains(hash) != h.Contains(hash) {
+			t.Errorf("Hash %s: expected %v", hash.ToString(), h.Contains(hash))
+		}
+		if replayed.Occurrences(hash) != h.Occurrences(hash) {
+			t.Errorf("Hash %s: expected %d occurrences", hash.ToString(), h.Occurrences(hash))
+		}
+	}
+
+	_, err = ReplayWAL(config, bytes.NewReader(make([]byte, 33)))
+	if err == nil {
+		t.Errorf("Expected an error for a bad operation")
+	}
+}
+
+func TestHammingReplayWALRemoveAll(t *testing.T) {
+	config := Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true}
+	h, _ := New(config)
+	var wal bytes.Buffer
+	h.AttachWAL(&wal)
+	xs := &XorShift1024Star{}
+	xs.Init()
+	for i := 0; i < 10; i++ {
+		h.Add(randomFuzzyHash(256, xs))
+	}
+	h.RemoveAll()
+	last := randomFuzzyHash(256, xs)
+	h.Add(last)
+
+	replayed, err := ReplayWAL(config, &wal)
+	if err != nil {
+		t.Fatalf("Failed to replay the log: %v", err)
+	}
+	if (replayed.Count() != 1) || !replayed.Contains(last) {
+		t.Errorf("Expected one hash, got %d", replayed.Count())
+	}
+	if err := replayed.Verify(); err != nil {
+		t.Errorf("Replayed index is broken: %v", err)
+	}
+}
+
+func TestHammingDupWAL(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	var wal bytes.Buffer
+	h.AttachWAL(&wal)
+	clone := h.Dup()
+	if &clone.walRecord[0] == &h.walRecord[0] {
+		t.Errorf("Expected a buffer of the clone")
+	}
+	clone.Add(allZerosHashBin.Dup())
+	if (wal.Len() != 33) || (wal.Bytes()[0] != walOpAdd) {
+		t.Errorf("Expected one record in the shared log, got %d bytes", wal.Len())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk is full")
+}
+
+func TestHammingWALError(t *testing.T) {
+	h, _ := New(Config{HashSize: 256, MaxDistance: 35, UseMultiindex: true})
+	h.AttachWAL(failingWriter{})
+	if !h.Add(allZerosHashBin.Dup()) {
+		t.Errorf("Failed to add a hash")
+	}
+	if h.WALError() == nil {
+		t.Errorf("Expected a write error")
+	}
+}